@@ -0,0 +1,75 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/swithek/sessionup"
+)
+
+// SessionActivity is a session along with when and from where it was last
+// used, as recorded by RecordActivity.
+type SessionActivity struct {
+	sessionup.Session
+
+	// LastSeenAt is when the session was last used. It is zero if no
+	// activity was recorded for the session.
+	LastSeenAt time.Time
+
+	// LastSeenIP is the IP address the session was last used from. It is nil
+	// if no activity was recorded for the session.
+	LastSeenIP net.IP
+}
+
+// RecordActivity records that the session with the given ID was used at the
+// given time from the given IP address.
+// To avoid writing on every request, the activity is only recorded when the
+// last recorded activity of the session is older than the threshold set with
+// WithActivityThreshold. Activity of expired sessions is not recorded.
+func (store *SqliteStore) RecordActivity(ctx context.Context, id string, ip net.IP, at time.Time) error {
+	at = at.UTC()
+	return store.retryBusy(ctx, func() error {
+		args := store.expiryArgs(store.now(), at, wrapNullString(ip.String()), id, at.Add(-store.activityThreshold))
+		_, err := store.stmt(recordActivityStatement).ExecContext(ctx, args...)
+		return err
+	})
+}
+
+// FetchActivityByUserKey retrieves the sessions associated with the provided
+// user key along with their last recorded activity, for example to list the
+// devices of a user. Like FetchByUserKey, expired sessions are not returned.
+func (store *SqliteStore) FetchActivityByUserKey(ctx context.Context, key string) ([]SessionActivity, error) {
+	rows, err := store.readStmt(fetchActivityByUserKeyStatement).QueryContext(ctx, store.expiryArgs(store.now(), key)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activities []SessionActivity
+	for rows.Next() {
+		var lastSeenAt sql.NullTime
+		var lastSeenIP sql.NullString
+		session, err := scanSession(rows, &lastSeenAt, &lastSeenIP)
+		if err != nil {
+			return nil, err
+		}
+		store.capExpiresAt(&session)
+
+		activity := SessionActivity{Session: session, LastSeenAt: lastSeenAt.Time.UTC()}
+		if lastSeenIP.Valid {
+			activity.LastSeenIP = net.ParseIP(lastSeenIP.String)
+		}
+		activities = append(activities, activity)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return activities, nil
+}
@@ -0,0 +1,74 @@
+package sqlitestore
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestRecordActivity(t *testing.T) {
+	store, mock := newMockStore(t, WithActivityThreshold(time.Minute))
+	id := "id"
+	ip := net.ParseIP("127.0.0.1")
+	query := `UPDATE "sessions" SET last_seen_at = $1, last_seen_ip = $2 WHERE id = $3 AND (last_seen_at IS NULL OR last_seen_at < $4) AND expires_at > $5;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC(), ip.String(), id, now.UTC().Add(-time.Minute), now.UTC()).WillReturnError(errDiskError)
+		err := store.RecordActivity(context.Background(), id, ip, now)
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("records the activity unless it was recorded less than the threshold ago", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC(), ip.String(), id, now.UTC().Add(-time.Minute), now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		err := store.RecordActivity(context.Background(), id, ip, now)
+		assertNoError(t, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("records a NULL IP address when it is unknown", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC(), nil, id, now.UTC().Add(-time.Minute), now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		err := store.RecordActivity(context.Background(), id, nil, now)
+		assertNoError(t, err)
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestFetchActivityByUserKey(t *testing.T) {
+	store, mock := newMockStore(t)
+	key := "key"
+	query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip FROM "sessions" WHERE user_key = $1 AND expires_at > $2;`
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata", "last_seen_at", "last_seen_ip"}
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectQuery(query).WithArgs(key, now.UTC()).WillReturnError(errDiskError)
+		_, err := store.FetchActivityByUserKey(context.Background(), key)
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns the sessions with their last recorded activity", func(t *testing.T) {
+		seen := sessionup.Session{ExpiresAt: now.UTC().Add(time.Hour), ID: "seen", UserKey: key}
+		unseen := sessionup.Session{ExpiresAt: now.UTC().Add(time.Hour), ID: "unseen", UserKey: key}
+		rows := sqlmock.NewRows(columns).
+			AddRow(seen.CreatedAt, seen.ExpiresAt, seen.ID, seen.UserKey, nil, nil, nil, nil, now, "127.0.0.1").
+			AddRow(unseen.CreatedAt, unseen.ExpiresAt, unseen.ID, unseen.UserKey, nil, nil, nil, nil, nil, nil)
+		mock.ExpectQuery(query).WithArgs(key, now.UTC()).WillReturnRows(rows)
+
+		activities, err := store.FetchActivityByUserKey(context.Background(), key)
+		assertNoError(t, err)
+		expected := []SessionActivity{
+			{Session: seen, LastSeenAt: now.UTC(), LastSeenIP: net.ParseIP("127.0.0.1")},
+			{Session: unseen},
+		}
+		if !reflect.DeepEqual(expected, activities) {
+			t.Errorf("want %v, got %v", expected, activities)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
@@ -0,0 +1,134 @@
+package sqlitestore_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	sqlitestore "github.com/hyzual/sessionup-sqlitestore"
+)
+
+// benchmarkSessionsCount is the number of sessions stored before running the
+// benchmarks, spread over benchmarkUserKeysCount user keys.
+const (
+	benchmarkSessionsCount = 100000
+	benchmarkUserKeysCount = 20000
+)
+
+func BenchmarkIndexes(b *testing.B) {
+	for _, withIndexes := range []bool{false, true} {
+		name := "without indexes"
+		if withIndexes {
+			name = "with indexes"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			db, store := openBenchmarkStore(b)
+			defer db.Close()
+			if !withIndexes {
+				for _, index := range []string{"sessions_user_key_idx", "sessions_expires_at_idx"} {
+					if _, err := db.Exec("DROP INDEX " + index + ";"); err != nil {
+						b.Fatalf("could not drop index %s: %v", index, err)
+					}
+				}
+			}
+
+			b.Run("FetchByUserKey", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					key := fmt.Sprintf("key%d", i%benchmarkUserKeysCount)
+					if _, err := store.FetchByUserKey(context.Background(), key); err != nil {
+						b.Fatalf("unexpected error while fetching the sessions by user key: %v", err)
+					}
+				}
+			})
+
+			b.Run("DeleteByUserKey", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := store.DeleteByUserKey(context.Background(), "unknown"); err != nil {
+						b.Fatalf("unexpected error while deleting the sessions by user key: %v", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkPreparedStatements(b *testing.B) {
+	db, store := openBenchmarkStore(b)
+	defer db.Close()
+
+	b.Run("FetchByID with a prepared statement", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			id := fmt.Sprintf("id%d", i%benchmarkSessionsCount)
+			if _, _, err := store.FetchByID(context.Background(), id); err != nil {
+				b.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+			}
+		}
+	})
+
+	b.Run("FetchByID with a query built on every call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			id := fmt.Sprintf("id%d", i%benchmarkSessionsCount)
+			query := fmt.Sprintf("SELECT %s FROM %s WHERE id = $1 AND expires_at > $2;", "created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata", "sessions")
+			row := db.QueryRowContext(context.Background(), query, id, time.Now().UTC())
+			var createdAt, expiresAt time.Time
+			var sessionID, userKey string
+			var ip, os, browser, metadata sql.NullString
+			err := row.Scan(&createdAt, &expiresAt, &sessionID, &userKey, &ip, &os, &browser, &metadata)
+			if err != nil && err != sql.ErrNoRows {
+				b.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+			}
+		}
+	})
+}
+
+// openBenchmarkStore returns a store whose table holds
+// benchmarkSessionsCount sessions, half of them expired.
+func openBenchmarkStore(b *testing.B) (*sql.DB, *sqlitestore.SqliteStore) {
+	b.Helper()
+
+	db, err := sql.Open(driverName, withDriverParams("file:benchmark.db?mode=memory"))
+	if err != nil {
+		b.Fatalf("could not open in-memory database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		db.Close()
+		b.Fatalf("could not create a new sessions table: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		b.Fatalf("could not begin a transaction: %v", err)
+	}
+	defer tx.Rollback() // nolint:errcheck // Rollback after Commit is a no-op
+
+	insert, err := tx.Prepare("INSERT INTO sessions (created_at, expires_at, id, user_key) VALUES ($1, $2, $3, $4);")
+	if err != nil {
+		db.Close()
+		b.Fatalf("could not prepare the insertion of sessions: %v", err)
+	}
+	now := time.Now().UTC()
+	for i := 0; i < benchmarkSessionsCount; i++ {
+		expiresAt := now.Add(time.Hour)
+		if i%2 == 0 {
+			expiresAt = now.Add(-time.Hour)
+		}
+		_, err = insert.Exec(now.Add(-2*time.Hour), expiresAt, fmt.Sprintf("id%d", i), fmt.Sprintf("key%d", i%benchmarkUserKeysCount))
+		if err != nil {
+			db.Close()
+			b.Fatalf("could not insert a session: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		db.Close()
+		b.Fatalf("could not commit the sessions: %v", err)
+	}
+
+	return db, store
+}
@@ -0,0 +1,375 @@
+package sqlitestore
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/swithek/sessionup"
+)
+
+// CacheStats reports how FetchByID used the caches set with WithCache and
+// WithNegativeCache.
+type CacheStats struct {
+	// Hits is how many sessions were found in the cache.
+	Hits uint64
+
+	// Misses is how many sessions were looked up in the database because
+	// they were not in the cache.
+	Misses uint64
+
+	// NegativeHits is how many lookups of unknown session IDs were answered
+	// by the negative cache without querying the database.
+	NegativeHits uint64
+}
+
+// CacheStats returns how many lookups of FetchByID were served by the caches
+// since the store was created. It returns zero counts for the caches the
+// store does not have.
+func (store *SqliteStore) CacheStats() CacheStats {
+	stats := store.cache.stats()
+	stats.NegativeHits = store.unknownIDs.stats().Hits
+	return stats
+}
+
+// sessionCache is a bounded cache of sessions by ID that evicts the least
+// recently used session when it is full. It is safe for concurrent use.
+// A nil sessionCache caches nothing.
+//
+// Every invalidation increments the generation of the cache. A session read
+// from the database is only added if no invalidation happened since the read
+// started, so that a session deleted or changed concurrently cannot be cached
+// in its former state.
+//
+// Sessions changed by a transaction in progress are pinned: they are not
+// cached until the transaction ends, as they could only be cached in the
+// state the transaction is about to change. A pin lasts for the TTL of the
+// cache at most, in case the end of the transaction is never reported.
+type sessionCache struct {
+	// hits and misses are accessed atomically, they come first to be
+	// aligned on 32-bit platforms.
+	hits   uint64
+	misses uint64
+
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	generation uint64
+	entries    map[string]*list.Element
+	// recent orders the entries from the most to the least recently used.
+	recent *list.List
+	// pinnedIDs and pinnedUserKeys hold the pins of the sessions with a
+	// given ID or user key.
+	pinnedIDs      map[string]*cachePin
+	pinnedUserKeys map[string]*cachePin
+}
+
+// pinTTL is how long a cache without TTL keeps a session pinned.
+const pinTTL = time.Minute
+
+// cachePin counts the transactions in progress that changed a session, which
+// is kept out of the cache until they end or until deadline.
+type cachePin struct {
+	count    int
+	deadline time.Time
+}
+
+// cacheEntry is a cached session, which is used until expiresAt.
+type cacheEntry struct {
+	session   sessionup.Session
+	expiresAt time.Time
+}
+
+// newSessionCache returns a cache holding up to size sessions for ttl at
+// most, or until they expire if ttl is not positive. It returns nil if size
+// is not positive.
+func newSessionCache(size int, ttl time.Duration) *sessionCache {
+	if size <= 0 {
+		return nil
+	}
+	return &sessionCache{
+		size:           size,
+		ttl:            ttl,
+		entries:        make(map[string]*list.Element, size),
+		recent:         list.New(),
+		pinnedIDs:      make(map[string]*cachePin),
+		pinnedUserKeys: make(map[string]*cachePin),
+	}
+}
+
+// newNegativeCache returns a cache remembering up to size unknown session
+// IDs for ttl, or nil if size or ttl is not positive, as unknown IDs have no
+// expiration time to fall back on.
+func newNegativeCache(size int, ttl time.Duration) *sessionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return newSessionCache(size, ttl)
+}
+
+// get returns a copy of the session with the given ID if it is cached and
+// still valid at now. It counts a hit when it does, the caller counts the
+// miss with countMiss once it looked the session up.
+func (c *sessionCache) get(id string, now time.Time) (sessionup.Session, bool) {
+	if c == nil {
+		return sessionup.Session{}, false
+	}
+
+	c.mu.Lock()
+	element, ok := c.entries[id]
+	if ok && !now.Before(element.Value.(*cacheEntry).expiresAt) {
+		c.removeElement(element)
+		ok = false
+	}
+	var session sessionup.Session
+	if ok {
+		c.recent.MoveToFront(element)
+		session = copySession(element.Value.(*cacheEntry).session)
+	}
+	c.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	}
+	return session, ok
+}
+
+// countMiss counts a session looked up in the database because it was not
+// in the cache.
+func (c *sessionCache) countMiss() {
+	if c == nil {
+		return
+	}
+	atomic.AddUint64(&c.misses, 1)
+}
+
+// currentGeneration returns the generation to give to put for the sessions
+// read from now on.
+func (c *sessionCache) currentGeneration() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put caches a copy of session, read from the database at now, until the
+// TTL of the cache or expiresAt, whichever comes first. It does nothing if
+// the cache was invalidated since generation.
+func (c *sessionCache) put(session sessionup.Session, now, expiresAt time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+	if ttlEnd := now.Add(c.ttl); c.ttl > 0 && ttlEnd.Before(expiresAt) {
+		expiresAt = ttlEnd
+	}
+	if !now.Before(expiresAt) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation || isPinned(c.pinnedIDs, session.ID, now) || isPinned(c.pinnedUserKeys, session.UserKey, now) {
+		return
+	}
+
+	entry := &cacheEntry{session: copySession(session), expiresAt: expiresAt}
+	if element, ok := c.entries[session.ID]; ok {
+		element.Value = entry
+		c.recent.MoveToFront(element)
+		return
+	}
+	c.entries[session.ID] = c.recent.PushFront(entry)
+	if c.recent.Len() > c.size {
+		c.removeElement(c.recent.Back())
+	}
+}
+
+// putUnknown caches that no session has the given ID, like put.
+func (c *sessionCache) putUnknown(id string, now time.Time, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.put(sessionup.Session{ID: id}, now, now.Add(c.ttl), generation)
+}
+
+// remove invalidates the sessions with the given IDs.
+func (c *sessionCache) remove(ids ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, id := range ids {
+		if element, ok := c.entries[id]; ok {
+			c.removeElement(element)
+		}
+	}
+}
+
+// removeUserKey invalidates the sessions of the given user key, except those
+// whose IDs are given.
+func (c *sessionCache) removeUserKey(key string, idsToKeep ...string) {
+	if c == nil {
+		return
+	}
+	keep := make(map[string]bool, len(idsToKeep))
+	for _, id := range idsToKeep {
+		keep[id] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for element := c.recent.Front(); element != nil; {
+		next := element.Next()
+		session := element.Value.(*cacheEntry).session
+		if session.UserKey == key && !keep[session.ID] {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+// pin invalidates the sessions with the given IDs or user keys, and keeps
+// them out of the cache until unpin is called with the same IDs and user
+// keys, or until the TTL of the cache ends.
+func (c *sessionCache) pin(ids, userKeys []string, now time.Time) {
+	if c == nil {
+		return
+	}
+	ttl := c.ttl
+	if ttl <= 0 {
+		ttl = pinTTL
+	}
+	deadline := now.Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addPins(c.pinnedIDs, ids, deadline)
+	addPins(c.pinnedUserKeys, userKeys, deadline)
+	c.removePinned(now)
+}
+
+// unpin lets the sessions pinned with the given IDs and user keys be cached
+// again. They are invalidated once more, so that a session read before the
+// end of the transaction that pinned it is not cached.
+func (c *sessionCache) unpin(ids, userKeys []string, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removePinned(now)
+	removePins(c.pinnedIDs, ids)
+	removePins(c.pinnedUserKeys, userKeys)
+}
+
+// removePinned drops the pins that are over at now, then invalidates the
+// pinned sessions. c.mu must be held.
+func (c *sessionCache) removePinned(now time.Time) {
+	for _, pins := range []map[string]*cachePin{c.pinnedIDs, c.pinnedUserKeys} {
+		for key, pin := range pins {
+			if !now.Before(pin.deadline) {
+				delete(pins, key)
+			}
+		}
+	}
+
+	c.generation++
+	for element := c.recent.Front(); element != nil; {
+		next := element.Next()
+		session := element.Value.(*cacheEntry).session
+		if c.pinnedIDs[session.ID] != nil || c.pinnedUserKeys[session.UserKey] != nil {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+// addPins pins the given keys in pins until deadline.
+func addPins(pins map[string]*cachePin, keys []string, deadline time.Time) {
+	for _, key := range keys {
+		pin, ok := pins[key]
+		if !ok {
+			pin = &cachePin{}
+			pins[key] = pin
+		}
+		pin.count++
+		pin.deadline = deadline
+	}
+}
+
+// removePins releases a pin of each of the given keys in pins.
+func removePins(pins map[string]*cachePin, keys []string) {
+	for _, key := range keys {
+		if pin, ok := pins[key]; ok {
+			if pin.count--; pin.count <= 0 {
+				delete(pins, key)
+			}
+		}
+	}
+}
+
+// isPinned reports whether key is pinned in pins at now, dropping its pin if
+// it is over.
+func isPinned(pins map[string]*cachePin, key string, now time.Time) bool {
+	pin, ok := pins[key]
+	if ok && !now.Before(pin.deadline) {
+		delete(pins, key)
+		return false
+	}
+	return ok
+}
+
+// removeExpired drops the sessions that are no longer valid at now.
+func (c *sessionCache) removeExpired(now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for element := c.recent.Front(); element != nil; {
+		next := element.Next()
+		if !now.Before(element.Value.(*cacheEntry).expiresAt) {
+			c.removeElement(element)
+		}
+		element = next
+	}
+}
+
+// removeElement drops element from the cache. c.mu must be held.
+func (c *sessionCache) removeElement(element *list.Element) {
+	c.recent.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).session.ID)
+}
+
+func (c *sessionCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+	}
+}
+
+// copySession returns a copy of session that shares no memory with it, so
+// that callers cannot change the cached sessions.
+func copySession(session sessionup.Session) sessionup.Session {
+	if session.IP != nil {
+		session.IP = append(net.IP(nil), session.IP...)
+	}
+	if session.Meta != nil {
+		meta := make(map[string]string, len(session.Meta))
+		for key, value := range session.Meta {
+			meta[key] = value
+		}
+		session.Meta = meta
+	}
+	return session
+}
@@ -0,0 +1,553 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestSessionCache(t *testing.T) {
+	newSession := func(id, key string) sessionup.Session {
+		return sessionup.Session{ExpiresAt: now.Add(time.Hour), ID: id, UserKey: key}
+	}
+	put := func(c *sessionCache, sessions ...sessionup.Session) {
+		for _, session := range sessions {
+			c.put(session, now, session.ExpiresAt, c.currentGeneration())
+		}
+	}
+
+	t.Run("evicts the least recently used session when it is full", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		put(c, newSession("a", "key"), newSession("b", "key"))
+		c.get("a", now)
+		put(c, newSession("c", "key"))
+
+		assertCached(t, c, "a", true)
+		assertCached(t, c, "b", false)
+		assertCached(t, c, "c", true)
+	})
+
+	t.Run("keeps sessions until the TTL ends", func(t *testing.T) {
+		c := newSessionCache(2, time.Minute)
+		put(c, newSession("a", "key"))
+
+		if _, ok := c.get("a", now.Add(time.Second*59)); !ok {
+			t.Error("want the session to be cached before the TTL ends")
+		}
+		if _, ok := c.get("a", now.Add(time.Minute)); ok {
+			t.Error("want the session not to be cached once the TTL ends")
+		}
+	})
+
+	t.Run("keeps sessions until they expire", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour*24)
+		session := newSession("a", "key")
+		put(c, session)
+
+		if _, ok := c.get("a", session.ExpiresAt); ok {
+			t.Error("want the session not to be cached once it expired")
+		}
+	})
+
+	t.Run("without TTL, keeps sessions until they expire", func(t *testing.T) {
+		c := newSessionCache(2, 0)
+		session := newSession("a", "key")
+		put(c, session)
+
+		if _, ok := c.get("a", session.ExpiresAt.Add(-time.Second)); !ok {
+			t.Error("want the session to be cached before it expires")
+		}
+		if _, ok := c.get("a", session.ExpiresAt); ok {
+			t.Error("want the session not to be cached once it expired")
+		}
+	})
+
+	t.Run("does not cache sessions read before an invalidation", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		generation := c.currentGeneration()
+		c.remove("a")
+		c.put(newSession("a", "key"), now, now.Add(time.Hour), generation)
+
+		assertCached(t, c, "a", false)
+	})
+
+	t.Run("removes the sessions of a user key", func(t *testing.T) {
+		c := newSessionCache(3, time.Hour)
+		put(c, newSession("a", "key"), newSession("b", "key"), newSession("c", "other"))
+		c.removeUserKey("key", "b")
+
+		assertCached(t, c, "a", false)
+		assertCached(t, c, "b", true)
+		assertCached(t, c, "c", true)
+	})
+
+	t.Run("removes the expired sessions", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		put(c, newSession("a", "key"))
+		c.put(newSession("b", "key"), now, now.Add(time.Minute), c.currentGeneration())
+		c.removeExpired(now.Add(time.Minute))
+
+		if len(c.entries) != 1 || c.recent.Len() != 1 {
+			t.Errorf("want 1 session left in the cache, got %d", len(c.entries))
+		}
+		assertCached(t, c, "a", true)
+	})
+
+	t.Run("returns copies of the cached sessions", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		session := newSession("a", "key")
+		session.IP = net.ParseIP("127.0.0.1")
+		session.Meta = map[string]string{"test": "1"}
+		put(c, session)
+		session.Meta["test"] = "2"
+
+		cached, _ := c.get("a", now)
+		cached.Meta["test"] = "3"
+		cached.IP[len(cached.IP)-1] = 2
+
+		cached, _ = c.get("a", now)
+		if cached.Meta["test"] != "1" || !cached.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("want the cached session to be unchanged, got %v", cached)
+		}
+	})
+
+	t.Run("does not cache pinned sessions", func(t *testing.T) {
+		c := newSessionCache(3, time.Hour)
+		put(c, newSession("a", "key"), newSession("b", "other"))
+		c.pin([]string{"a"}, []string{"other"}, now)
+
+		assertCached(t, c, "a", false)
+		assertCached(t, c, "b", false)
+		put(c, newSession("a", "key"), newSession("b", "other"), newSession("c", "other"))
+		assertCached(t, c, "a", false)
+		assertCached(t, c, "b", false)
+		assertCached(t, c, "c", false)
+	})
+
+	t.Run("caches sessions again once they are unpinned", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		c.pin([]string{"a"}, nil, now)
+		c.pin([]string{"a"}, nil, now)
+		generation := c.currentGeneration()
+
+		c.unpin([]string{"a"}, nil, now)
+		put(c, newSession("a", "key"))
+		assertCached(t, c, "a", false)
+
+		c.unpin([]string{"a"}, nil, now)
+		c.put(newSession("a", "key"), now, now.Add(time.Hour), generation)
+		assertCached(t, c, "a", false)
+		put(c, newSession("a", "key"))
+		assertCached(t, c, "a", true)
+	})
+
+	t.Run("drops the pins once the TTL ends", func(t *testing.T) {
+		c := newSessionCache(2, time.Minute)
+		c.pin([]string{"a"}, []string{"key"}, now)
+
+		c.put(newSession("a", "key"), now.Add(time.Second*59), now.Add(time.Hour), c.currentGeneration())
+		assertCached(t, c, "a", false)
+		c.put(newSession("a", "key"), now.Add(time.Minute), now.Add(time.Hour), c.currentGeneration())
+		assertCached(t, c, "a", true)
+		if len(c.pinnedIDs) != 0 || len(c.pinnedUserKeys) != 0 {
+			t.Errorf("want no pins left, got %v and %v", c.pinnedIDs, c.pinnedUserKeys)
+		}
+	})
+
+	t.Run("without TTL, drops the pins after a minute", func(t *testing.T) {
+		c := newSessionCache(2, 0)
+		c.pin(nil, []string{"key"}, now)
+		c.pin([]string{"b"}, nil, now.Add(pinTTL))
+
+		if _, ok := c.pinnedUserKeys["key"]; ok {
+			t.Error("want the pin of the user key to be dropped")
+		}
+		if _, ok := c.pinnedIDs["b"]; !ok {
+			t.Error("want the pin of the ID to be kept")
+		}
+	})
+
+	t.Run("counts hits and misses", func(t *testing.T) {
+		c := newSessionCache(2, time.Hour)
+		put(c, newSession("a", "key"))
+		c.get("a", now)
+		c.get("a", now)
+		c.get("b", now)
+		c.countMiss()
+
+		expected := CacheStats{Hits: 2, Misses: 1}
+		if actual := c.stats(); actual != expected {
+			t.Errorf("want %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("without size, it caches nothing", func(t *testing.T) {
+		c := newSessionCache(0, time.Hour)
+		put(c, newSession("a", "key"))
+		c.remove("a")
+		c.removeUserKey("key")
+		c.removeExpired(now)
+
+		if _, ok := c.get("a", now); ok {
+			t.Error("want the session not to be cached")
+		}
+		if stats := c.stats(); stats != (CacheStats{}) {
+			t.Errorf("want no stats, got %+v", stats)
+		}
+	})
+}
+
+func assertCached(t *testing.T, c *sessionCache, id string, expected bool) {
+	t.Helper()
+	c.mu.Lock()
+	_, actual := c.entries[id]
+	c.mu.Unlock()
+	if actual != expected {
+		t.Errorf("want session %q cached %t, got %t", id, expected, actual)
+	}
+}
+
+func TestFetchByIDWithCache(t *testing.T) {
+	fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}
+	session := sessionup.Session{CreatedAt: now.UTC(), ExpiresAt: now.UTC().Add(time.Hour), ID: "id", UserKey: "key"}
+	expectFetch := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(session.CreatedAt, session.ExpiresAt, "id", "key", nil, nil, nil, nil),
+		)
+	}
+	fetch := func(t *testing.T, store *SqliteStore) {
+		t.Helper()
+		actual, found, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !found || !reflect.DeepEqual(session, actual) {
+			t.Errorf("want %v, got %v (found: %t)", session, actual, found)
+		}
+	}
+
+	t.Run("serves the fetched sessions from the cache", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, time.Minute))
+		expectFetch(mock)
+
+		fetch(t, store)
+		fetch(t, store)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats != (CacheStats{Hits: 1, Misses: 1}) {
+			t.Errorf("want 1 hit and 1 miss, got %+v", stats)
+		}
+	})
+
+	t.Run("without TTL, serves the fetched sessions from the cache", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, 0))
+		expectFetch(mock)
+
+		fetch(t, store)
+		fetch(t, store)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats != (CacheStats{Hits: 1, Misses: 1}) {
+			t.Errorf("want 1 hit and 1 miss, got %+v", stats)
+		}
+	})
+
+	t.Run("does not cache the sessions to extend", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, time.Minute), WithSlidingExpiration(time.Hour*2, time.Hour))
+		expectFetch(mock)
+		expectFetch(mock)
+
+		fetch(t, store)
+		fetch(t, store)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	invalidations := map[string]struct {
+		Expect     func(sqlmock.Sqlmock)
+		Invalidate func(*SqliteStore) error
+	}{
+		"DeleteByID": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM "sessions" WHERE id = $1;`).WithArgs("id").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			Invalidate: func(store *SqliteStore) error {
+				return store.DeleteByID(context.Background(), "id")
+			},
+		},
+		"DeleteByUserKey": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`DELETE FROM "sessions" WHERE user_key = $1;`).WithArgs("key").WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			Invalidate: func(store *SqliteStore) error {
+				return store.DeleteByUserKey(context.Background(), "key")
+			},
+		},
+		"Touch": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE "sessions" SET expires_at = $1 WHERE id = $2 AND expires_at > $3;`).
+					WithArgs(now.UTC().Add(time.Hour*2), "id", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			Invalidate: func(store *SqliteStore) error {
+				_, err := store.Touch(context.Background(), "id", now.Add(time.Hour*2))
+				return err
+			},
+		},
+		"UpdateMeta": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE "sessions" SET metadata = NULLIF(json_patch(COALESCE(metadata, '{}'), $1), '{}') WHERE id = $2 AND expires_at > $3;`).
+					WithArgs(`{"test":"1"}`, "id", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			Invalidate: func(store *SqliteStore) error {
+				_, err := store.UpdateMeta(context.Background(), "id", map[string]string{"test": "1"}, nil)
+				return err
+			},
+		},
+		"WithTx": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`DELETE FROM "sessions" WHERE id = $1;`).WithArgs("id").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			Invalidate: func(store *SqliteStore) error {
+				tx, err := store.db.Begin()
+				if err != nil {
+					return err
+				}
+				txStore := store.WithTx(tx)
+				if err = txStore.DeleteByID(context.Background(), "id"); err != nil {
+					return err
+				}
+				return txStore.Commit()
+			},
+		},
+	}
+
+	for name, invalidation := range invalidations {
+		t.Run(name+" removes the session from the cache", func(t *testing.T) {
+			store, mock := newMockStore(t, WithCache(10, time.Minute))
+			expectFetch(mock)
+			invalidation.Expect(mock)
+			expectFetch(mock)
+
+			fetch(t, store)
+			assertNoError(t, invalidation.Invalidate(store))
+			fetch(t, store)
+			assertExpectationsWereMet(t, mock)
+		})
+	}
+}
+
+func TestFetchByIDWithNegativeCache(t *testing.T) {
+	fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
+	expectNotFound := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnError(sql.ErrNoRows)
+	}
+	fetchNotFound := func(t *testing.T, store *SqliteStore) {
+		t.Helper()
+		_, found, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if found {
+			t.Error("want the session not to be found")
+		}
+	}
+
+	t.Run("does not look up unknown IDs again", func(t *testing.T) {
+		store, mock := newMockStore(t, WithNegativeCache(10, time.Second*10))
+		expectNotFound(mock)
+
+		fetchNotFound(t, store)
+		fetchNotFound(t, store)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats != (CacheStats{NegativeHits: 1}) {
+			t.Errorf("want 1 negative hit, got %+v", stats)
+		}
+	})
+
+	t.Run("does not count the negative hits as misses", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, time.Minute), WithNegativeCache(10, time.Second*10))
+		expectNotFound(mock)
+
+		fetchNotFound(t, store)
+		fetchNotFound(t, store)
+		fetchNotFound(t, store)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats != (CacheStats{Misses: 1, NegativeHits: 2}) {
+			t.Errorf("want 1 miss and 2 negative hits, got %+v", stats)
+		}
+	})
+
+	t.Run("without TTL, does not remember unknown IDs", func(t *testing.T) {
+		store, mock := newMockStore(t, WithNegativeCache(10, 0))
+		expectNotFound(mock)
+		expectNotFound(mock)
+
+		fetchNotFound(t, store)
+		fetchNotFound(t, store)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats != (CacheStats{}) {
+			t.Errorf("want no stats, got %+v", stats)
+		}
+	})
+
+	t.Run("does not remember errors", func(t *testing.T) {
+		store, mock := newMockStore(t, WithNegativeCache(10, time.Second*10))
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnError(errDiskError)
+		expectNotFound(mock)
+
+		_, _, err := store.FetchByID(context.Background(), "id")
+		assertError(t, errDiskError, err)
+		fetchNotFound(t, store)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	invalidations := map[string]struct {
+		Expect     func(sqlmock.Sqlmock)
+		Invalidate func(*SqliteStore) error
+	}{
+		"Create": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			Invalidate: func(store *SqliteStore) error {
+				return store.Create(context.Background(), sessionup.Session{ID: "id", UserKey: "key"})
+			},
+		},
+		"Rotate": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip) SELECT created_at, $1, $2, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip FROM "sessions" WHERE id = $3 AND expires_at > $4;`).
+					WithArgs(now.UTC().Add(time.Hour), "id", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(`DELETE FROM "sessions" WHERE id = $1;`).WithArgs("old").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			Invalidate: func(store *SqliteStore) error {
+				_, err := store.Rotate(context.Background(), "old", "id", now.Add(time.Hour))
+				return err
+			},
+		},
+		"WithTx": {
+			Expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(`INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+			},
+			Invalidate: func(store *SqliteStore) error {
+				tx, err := store.db.Begin()
+				if err != nil {
+					return err
+				}
+				txStore := store.WithTx(tx)
+				if err = txStore.Create(context.Background(), sessionup.Session{ID: "id", UserKey: "key"}); err != nil {
+					return err
+				}
+				return txStore.Commit()
+			},
+		},
+	}
+
+	for name, invalidation := range invalidations {
+		t.Run(name+" forgets that the ID is unknown", func(t *testing.T) {
+			store, mock := newMockStore(t, WithNegativeCache(10, time.Second*10))
+			expectNotFound(mock)
+			invalidation.Expect(mock)
+			expectNotFound(mock)
+
+			fetchNotFound(t, store)
+			assertNoError(t, invalidation.Invalidate(store))
+			fetchNotFound(t, store)
+			assertExpectationsWereMet(t, mock)
+		})
+	}
+}
+
+func TestFetchByIDWithCacheAndTx(t *testing.T) {
+	fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
+	deleteQuery := `DELETE FROM "sessions" WHERE id = $1;`
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}
+	expectFound := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(now.UTC(), now.UTC().Add(time.Hour), "id", "key", nil, nil, nil, nil),
+		)
+	}
+	begin := func(t *testing.T, store *SqliteStore, mock sqlmock.Sqlmock) *TxStore {
+		t.Helper()
+		mock.ExpectBegin()
+		tx, err := store.db.Begin()
+		assertNoError(t, err)
+		return store.WithTx(tx)
+	}
+	fetch := func(t *testing.T, store *SqliteStore, expectedFound bool) {
+		t.Helper()
+		_, found, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if found != expectedFound {
+			t.Errorf("want found %t, got %t", expectedFound, found)
+		}
+	}
+
+	t.Run("does not cache a session deleted by a transaction in progress", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, time.Minute))
+		txStore := begin(t, store, mock)
+		mock.ExpectExec(deleteQuery).WithArgs("id").WillReturnResult(sqlmock.NewResult(0, 1))
+		assertNoError(t, txStore.DeleteByID(context.Background(), "id"))
+
+		// Until the transaction is committed, the session is still found. As
+		// the transaction holds the first connection, the store prepares its
+		// statement again on a second one.
+		mock.ExpectPrepare(fetchQuery)
+		expectFound(mock)
+		expectFound(mock)
+		fetch(t, store, true)
+		fetch(t, store, true)
+
+		mock.ExpectCommit()
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnError(sql.ErrNoRows)
+		assertNoError(t, txStore.Commit())
+		fetch(t, store, false)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("does not cache a session read before the transaction ended", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCache(10, time.Minute))
+		txStore := begin(t, store, mock)
+		mock.ExpectExec(`DELETE FROM "sessions" WHERE user_key = $1;`).WithArgs("key").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+		assertNoError(t, txStore.DeleteByUserKey(context.Background(), "key"))
+		generation := store.cache.currentGeneration()
+		assertNoError(t, txStore.Rollback())
+
+		// A fetch that started while the session was pinned finishes after
+		// the rollback.
+		store.cache.put(sessionup.Session{ID: "id", UserKey: "key", ExpiresAt: now.Add(time.Hour)}, now, now.Add(time.Hour), generation)
+		expectFound(mock)
+		fetch(t, store, true)
+		fetch(t, store, true)
+		assertExpectationsWereMet(t, mock)
+		if stats := store.CacheStats(); stats.Hits != 1 {
+			t.Errorf("want the session to be cached after the rollback, got %+v", stats)
+		}
+	})
+
+	t.Run("does not remember as unknown a session created by a transaction in progress", func(t *testing.T) {
+		store, mock := newMockStore(t, WithNegativeCache(10, time.Minute))
+		txStore := begin(t, store, mock)
+		mock.ExpectExec(`INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		assertNoError(t, txStore.Create(context.Background(), sessionup.Session{ID: "id", UserKey: "key"}))
+
+		mock.ExpectPrepare(fetchQuery)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnError(sql.ErrNoRows)
+		fetch(t, store, false)
+
+		mock.ExpectCommit()
+		expectFound(mock)
+		assertNoError(t, txStore.Commit())
+		fetch(t, store, true)
+		assertExpectationsWereMet(t, mock)
+	})
+}
@@ -0,0 +1,178 @@
+package sqlitestore
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// deleteExpired deletes all expired sessions and returns how many were
+// deleted. Unless batching is disabled, sessions are deleted in batches so
+// that other writers can take SQLite's write lock between batches.
+// Deletion stops early if the cleanup is being stopped.
+func (store *SqliteStore) deleteExpired() (int64, error) {
+	args := store.expiryArgs(store.now())
+	stmt := store.stmt(deleteExpiredStatement)
+	if store.cleanupBatchSize <= 0 {
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+
+	args = append(args, store.cleanupBatchSize)
+	var deleted int64
+	for {
+		result, err := stmt.Exec(args...)
+		if err != nil {
+			return deleted, err
+		}
+		batchDeleted, err := result.RowsAffected()
+		deleted += batchDeleted
+		if err != nil || batchDeleted < int64(store.cleanupBatchSize) {
+			return deleted, err
+		}
+
+		if !store.pauseCleanup() {
+			return deleted, nil
+		}
+	}
+}
+
+// pauseCleanup waits between two batches of deletion. It returns false if
+// the cleanup is being stopped.
+func (store *SqliteStore) pauseCleanup() bool {
+	if store.cleanupBatchPause <= 0 {
+		select {
+		case <-store.stopChan:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(store.cleanupBatchPause)
+	defer timer.Stop()
+	select {
+	case <-store.stopChan:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// startCleanup starts deleting the expired sessions at every tick in a new
+// goroutine.
+func (store *SqliteStore) startCleanup(ticker Ticker) {
+	store.stopChan = make(chan struct{})
+	store.doneChan = make(chan struct{})
+	go store.cleanup(ticker)
+}
+
+func (store *SqliteStore) cleanup(ticker Ticker) {
+	defer close(store.doneChan)
+	defer ticker.Stop()
+
+	var retryAt time.Time
+	for {
+		select {
+		case tick := <-ticker.C():
+			if tick.Before(retryAt) {
+				continue
+			}
+
+			deleted, err := store.deleteExpired()
+			store.cache.removeExpired(store.now())
+			store.unknownIDs.removeExpired(store.now())
+			if store.resultHandler != nil {
+				store.resultHandler(deleted)
+			}
+			if err == nil {
+				atomic.StoreInt32(&store.cleanupFailures, 0)
+				retryAt = time.Time{}
+				continue
+			}
+
+			failures := atomic.AddInt32(&store.cleanupFailures, 1)
+			if store.dialect.IsTransient(err) {
+				retryAt = tick.Add(cleanupBackoff(store.cleanupInterval, store.cleanupMaxBackoff, failures))
+			}
+			store.reportCleanupError(err)
+
+		case <-store.stopChan:
+			return
+		}
+	}
+}
+
+// reportCleanupError hands err to the error handler and to the error
+// channel, if they were set. It never blocks on the channel: the error is
+// dropped when the channel is full.
+func (store *SqliteStore) reportCleanupError(err error) {
+	if store.errHandler != nil {
+		store.errHandler(err)
+	}
+	if store.errChan != nil {
+		select {
+		case store.errChan <- err:
+		default:
+		}
+	}
+}
+
+// cleanupBackoff returns how long to wait before trying to delete the expired
+// sessions again after the given number of consecutive failures. The delay
+// doubles with each failure, up to maxBackoff.
+func cleanupBackoff(interval, maxBackoff time.Duration, failures int32) time.Duration {
+	backoff := interval
+	for i := int32(0); i < failures; i++ {
+		backoff *= 2
+		if backoff >= maxBackoff || backoff <= 0 {
+			return maxBackoff
+		}
+	}
+	return backoff
+}
+
+// CleanupFailures returns how many times in a row the automatic cleanup
+// failed. It is reset to 0 by the next successful cleanup.
+func (store *SqliteStore) CleanupFailures() int {
+	return int(atomic.LoadInt32(&store.cleanupFailures))
+}
+
+// stopCleanup terminates the automatic cleanup process and waits for any
+// cleanup in progress to finish, unless ctx is done before.
+func (store *SqliteStore) stopCleanup(ctx context.Context) error {
+	if store.stopChan == nil {
+		return nil
+	}
+
+	store.stopOnce.Do(func() {
+		close(store.stopChan)
+	})
+
+	select {
+	case <-store.doneChan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StopCleanup terminates the automatic cleanup process and waits for any
+// cleanup in progress to finish. The store remains usable.
+// Useful for testing and cases when store is used only temporarily.
+// In order to restart the cleanup, a new store must be created.
+func (store *SqliteStore) StopCleanup() {
+	_ = store.stopCleanup(context.Background())
+}
+
+// CleanupErr returns a receive-only channel to get errors produced during the
+// automatic cleanup. It returns nil unless the store was created by New or
+// with WithCleanupErrorChannel.
+// Errors are dropped when the channel is full, so the cleanup process never
+// waits for the channel to be drained.
+func (store *SqliteStore) CleanupErr() <-chan error {
+	return store.errChan
+}
@@ -0,0 +1,235 @@
+package sqlitestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestDeleteExpired(t *testing.T) {
+	store, mock := newMockStore(t, WithCleanupBatchSize(0))
+	query := `DELETE FROM "sessions" WHERE expires_at < $1;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnError(errDiskError)
+		_, err := store.deleteExpired()
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("deletes all the expired sessions in DB", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnResult(sqlmock.NewResult(0, 3))
+		deleted, err := store.deleteExpired()
+		assertNoError(t, err)
+		assertDeletedCount(t, 3, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestDeleteExpiredInBatches(t *testing.T) {
+	store, mock := newMockStore(t, WithCleanupBatchSize(2))
+	query := `DELETE FROM "sessions" WHERE rowid IN (SELECT rowid FROM "sessions" WHERE expires_at < $1 LIMIT $2);`
+
+	t.Run("deletes batches until one is not full", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		deleted, err := store.deleteExpired()
+		assertNoError(t, err)
+		assertDeletedCount(t, 5, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("when a batch fails, it should return the error and what was deleted before", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnError(errDiskError)
+		deleted, err := store.deleteExpired()
+		assertError(t, errDiskError, err)
+		assertDeletedCount(t, 2, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("stops between batches when the cleanup is being stopped", func(t *testing.T) {
+		store, mock := newMockStore(t, WithCleanupBatchSize(2), WithCleanupBatchPause(time.Hour))
+		store.stopChan = make(chan struct{})
+		close(store.stopChan)
+		mock.ExpectExec(query).WithArgs(now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+		deleted, err := store.deleteExpired()
+		assertNoError(t, err)
+		assertDeletedCount(t, 2, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestDeleteExpiredWithMaxLifetime(t *testing.T) {
+	cutoff := now.UTC().Add(time.Hour * -24)
+
+	t.Run("deletes the sessions older than the maximum lifetime", func(t *testing.T) {
+		store, mock := newMockStore(t, WithMaxLifetime(time.Hour*24), WithCleanupBatchSize(0))
+		query := `DELETE FROM "sessions" WHERE (expires_at < $1 OR created_at < $2);`
+		mock.ExpectExec(query).WithArgs(now.UTC(), cutoff).WillReturnResult(sqlmock.NewResult(0, 3))
+		deleted, err := store.deleteExpired()
+		assertNoError(t, err)
+		assertDeletedCount(t, 3, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("deletes them in batches", func(t *testing.T) {
+		store, mock := newMockStore(t, WithMaxLifetime(time.Hour*24), WithCleanupBatchSize(2))
+		query := `DELETE FROM "sessions" WHERE rowid IN (SELECT rowid FROM "sessions" WHERE (expires_at < $1 OR created_at < $2) LIMIT $3);`
+		mock.ExpectExec(query).WithArgs(now.UTC(), cutoff, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		deleted, err := store.deleteExpired()
+		assertNoError(t, err)
+		assertDeletedCount(t, 1, deleted)
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func assertDeletedCount(t *testing.T, expected, actual int64) {
+	t.Helper()
+	if actual != expected {
+		t.Errorf("want %d deleted sessions, got %d", expected, actual)
+	}
+}
+
+func TestClose(t *testing.T) {
+	query := `DELETE FROM "sessions" WHERE expires_at < $1;`
+
+	newCleanupStore := func(t *testing.T) (*SqliteStore, sqlmock.Sqlmock, chan time.Time) {
+		t.Helper()
+		store, mock := newMockStore(t, WithCleanupBatchSize(0))
+		ticks := make(chan time.Time)
+		store.startCleanup(manualTicker(ticks))
+		return store, mock, ticks
+	}
+
+	t.Run("does nothing when the cleanup was never started", func(t *testing.T) {
+		store := SqliteStore{}
+		assertNoError(t, store.Close(context.Background()))
+	})
+
+	t.Run("can be called several times", func(t *testing.T) {
+		store, _, _ := newCleanupStore(t)
+		assertNoError(t, store.Close(context.Background()))
+		assertNoError(t, store.Close(context.Background()))
+		store.StopCleanup()
+	})
+
+	t.Run("releases the prepared statements", func(t *testing.T) {
+		store, _, _ := newCleanupStore(t)
+		assertNoError(t, store.Close(context.Background()))
+
+		_, _, err := store.FetchByID(context.Background(), "id")
+		if err == nil {
+			t.Error("expected an error when using a closed store, but did not get one")
+		}
+	})
+
+	t.Run("waits for the cleanup in progress", func(t *testing.T) {
+		store, mock, ticks := newCleanupStore(t)
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillDelayFor(time.Millisecond * 50).WillReturnResult(sqlmock.NewResult(0, 1))
+		ticks <- now
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		assertError(t, context.DeadlineExceeded, store.Close(ctx))
+
+		assertNoError(t, store.Close(context.Background()))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("does not block when cleanup errors are not drained", func(t *testing.T) {
+		store, mock, ticks := newCleanupStore(t)
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnError(errDiskError)
+		ticks <- now
+
+		assertNoError(t, store.Close(context.Background()))
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestCleanupErrors(t *testing.T) {
+	query := `DELETE FROM "sessions" WHERE expires_at < $1;`
+	errBusy := codeError(sqliteBusy)
+
+	t.Run("reports errors to the handler and the channel without blocking", func(t *testing.T) {
+		var handled []error
+		store, mock := newMockStore(
+			t,
+			WithCleanupInterval(time.Minute),
+			WithCleanupMaxBackoff(time.Hour),
+			WithCleanupBatchSize(0),
+			WithCleanupErrorHandler(func(err error) { handled = append(handled, err) }),
+			WithCleanupErrorChannel(1),
+		)
+		ticks := make(chan time.Time)
+		store.startCleanup(manualTicker(ticks))
+
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnError(errDiskError)
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnError(errDiskError)
+		ticks <- now
+		ticks <- now
+		assertNoError(t, store.Close(context.Background()))
+
+		if len(handled) != 2 {
+			t.Errorf("want 2 errors handled, got %d", len(handled))
+		}
+		assertError(t, errDiskError, <-store.CleanupErr())
+		if failures := store.CleanupFailures(); failures != 2 {
+			t.Errorf("want 2 consecutive failures, got %d", failures)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("backs off while the database is locked", func(t *testing.T) {
+		var handled []error
+		store, mock := newMockStore(
+			t,
+			WithCleanupInterval(time.Minute),
+			WithCleanupMaxBackoff(time.Hour),
+			WithCleanupBatchSize(0),
+			WithCleanupErrorHandler(func(err error) { handled = append(handled, err) }),
+		)
+		ticks := make(chan time.Time)
+		store.startCleanup(manualTicker(ticks))
+
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnError(errBusy)
+		mock.ExpectExec(query).WithArgs(now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		ticks <- now
+		// The next attempt is 2 minutes later, ticks before are skipped.
+		ticks <- now.Add(time.Minute)
+		ticks <- now.Add(time.Minute * 2)
+		assertNoError(t, store.Close(context.Background()))
+
+		if len(handled) != 1 {
+			t.Errorf("want 1 error handled, got %v", handled)
+		}
+		if failures := store.CleanupFailures(); failures != 0 {
+			t.Errorf("want consecutive failures to be reset, got %d", failures)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestCleanupBackoff(t *testing.T) {
+	tests := map[string]struct {
+		Failures int32
+		Expected time.Duration
+	}{
+		"doubles the interval after the first failure": {Failures: 1, Expected: time.Minute * 2},
+		"doubles the delay after each failure":         {Failures: 3, Expected: time.Minute * 8},
+		"does not exceed the maximum":                  {Failures: 10, Expected: time.Hour},
+		"does not overflow":                            {Failures: 100, Expected: time.Hour},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			actual := cleanupBackoff(time.Minute, time.Hour, testDefinition.Failures)
+			if actual != testDefinition.Expected {
+				t.Errorf("want %s, got %s", testDefinition.Expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package sqlitestore
+
+import "time"
+
+// Clock tells the store what time it is. It determines which sessions are
+// expired and schedules the automatic cleanup.
+// The sqlitestoretest package provides a fake implementation for tests.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTicker returns a Ticker that ticks every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks at regular intervals, like time.Ticker.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+
+	// Stop turns off the ticker. No more ticks will be delivered after it
+	// returns.
+	Stop()
+}
+
+// realClock is a Clock backed by the wall clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTicker adapts time.Ticker to the Ticker interface.
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
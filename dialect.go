@@ -0,0 +1,136 @@
+package sqlitestore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Dialect interprets the errors of the SQLite driver the store is used with.
+// MattnDialect supports github.com/mattn/go-sqlite3, which requires cgo, and
+// ModerncDialect supports the pure Go modernc.org/sqlite. By default, the
+// store recognizes the errors of both drivers, or only those of
+// modernc.org/sqlite when cgo is disabled.
+type Dialect interface {
+	// IsConstraintViolation reports whether err was produced by a violated
+	// constraint, such as the uniqueness of session IDs.
+	IsConstraintViolation(err error) bool
+
+	// IsBusy reports whether err was produced because the database or one
+	// of its tables is locked by another connection. The operation that
+	// failed can be tried again.
+	IsBusy(err error) bool
+
+	// IsTransient reports whether err is expected to go away by itself:
+	// the database is locked by another connection or the disk is full.
+	IsTransient(err error) bool
+}
+
+// SQLite primary result codes, see https://www.sqlite.org/rescode.html.
+const (
+	sqliteBusy       = 5
+	sqliteLocked     = 6
+	sqliteFull       = 13
+	sqliteConstraint = 19
+)
+
+// ModerncDialect is the Dialect of modernc.org/sqlite, which does not require
+// cgo. Its errors are recognized by their Code method, so this package does
+// not need to import the driver.
+// The driver must be configured with the "_time_format=sqlite" DSN parameter
+// so that it writes timestamps in the format expected by the store, which
+// Open does.
+type ModerncDialect struct{}
+
+func (ModerncDialect) driverName() string {
+	return "sqlite"
+}
+
+func (ModerncDialect) dsn(path string) string {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", openBusyTimeout.Milliseconds()))
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", "synchronous(NORMAL)")
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Set("_time_format", "sqlite")
+	return withParams(path, params)
+}
+
+// IsConstraintViolation implements Dialect interface's IsConstraintViolation
+// method.
+func (ModerncDialect) IsConstraintViolation(err error) bool {
+	return moderncCode(err) == sqliteConstraint
+}
+
+// IsBusy implements Dialect interface's IsBusy method.
+func (ModerncDialect) IsBusy(err error) bool {
+	code := moderncCode(err)
+	return code == sqliteBusy || code == sqliteLocked
+}
+
+// IsTransient implements Dialect interface's IsTransient method.
+func (d ModerncDialect) IsTransient(err error) bool {
+	return d.IsBusy(err) || moderncCode(err) == sqliteFull
+}
+
+// moderncCode returns the primary result code of err if it is a
+// modernc.org/sqlite error, -1 otherwise.
+func moderncCode(err error) int {
+	var coder interface{ Code() int }
+	if !errors.As(err, &coder) {
+		return -1
+	}
+	// Extended result codes carry the primary result code in their least
+	// significant byte.
+	return coder.Code() & 0xff
+}
+
+// dialects is a Dialect recognizing the errors of any of its dialects.
+type dialects []Dialect
+
+// Open uses the driver of the first dialect that has one.
+func (d dialects) driverName() string {
+	return d.opener().driverName()
+}
+
+func (d dialects) dsn(path string) string {
+	return d.opener().dsn(path)
+}
+
+// opener returns the first dialect that can open a database. The default
+// dialects always have one.
+func (d dialects) opener() opener {
+	for _, dialect := range d {
+		if o, ok := dialect.(opener); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+func (d dialects) IsConstraintViolation(err error) bool {
+	for _, dialect := range d {
+		if dialect.IsConstraintViolation(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d dialects) IsBusy(err error) bool {
+	for _, dialect := range d {
+		if dialect.IsBusy(err) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d dialects) IsTransient(err error) bool {
+	for _, dialect := range d {
+		if dialect.IsTransient(err) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+//go:build cgo
+// +build cgo
+
+package sqlitestore
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// defaultDialect recognizes the errors of both supported drivers.
+var defaultDialect Dialect = dialects{MattnDialect{}, ModerncDialect{}}
+
+// MattnDialect is the Dialect of github.com/mattn/go-sqlite3. It is only
+// available when cgo is enabled.
+type MattnDialect struct{}
+
+func (MattnDialect) driverName() string {
+	return "sqlite3"
+}
+
+func (MattnDialect) dsn(path string) string {
+	params := url.Values{}
+	params.Set("_busy_timeout", strconv.FormatInt(openBusyTimeout.Milliseconds(), 10))
+	params.Set("_journal_mode", "WAL")
+	params.Set("_synchronous", "NORMAL")
+	params.Set("_foreign_keys", "1")
+	return withParams(path, params)
+}
+
+// IsConstraintViolation implements Dialect interface's IsConstraintViolation
+// method.
+func (MattnDialect) IsConstraintViolation(err error) bool {
+	var sqliteError sqlite3.Error
+	return errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrConstraint
+}
+
+// IsBusy implements Dialect interface's IsBusy method.
+func (MattnDialect) IsBusy(err error) bool {
+	var sqliteError sqlite3.Error
+	if !errors.As(err, &sqliteError) {
+		return false
+	}
+	return sqliteError.Code == sqlite3.ErrBusy || sqliteError.Code == sqlite3.ErrLocked
+}
+
+// IsTransient implements Dialect interface's IsTransient method.
+func (d MattnDialect) IsTransient(err error) bool {
+	var sqliteError sqlite3.Error
+	return d.IsBusy(err) || (errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrFull)
+}
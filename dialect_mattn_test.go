@@ -0,0 +1,51 @@
+//go:build cgo
+// +build cgo
+
+package sqlitestore
+
+import (
+	"testing"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+func TestMattnDialect(t *testing.T) {
+	tests := map[string]struct {
+		Err                         error
+		ExpectedConstraintViolation bool
+		ExpectedBusy                bool
+		ExpectedTransient           bool
+	}{
+		"database is busy":    {Err: sqlite3.Error{Code: sqlite3.ErrBusy}, ExpectedBusy: true, ExpectedTransient: true},
+		"table is locked":     {Err: sqlite3.Error{Code: sqlite3.ErrLocked}, ExpectedBusy: true, ExpectedTransient: true},
+		"disk is full":        {Err: sqlite3.Error{Code: sqlite3.ErrFull}, ExpectedTransient: true},
+		"constraint failed":   {Err: sqlite3.Error{Code: sqlite3.ErrConstraint}, ExpectedConstraintViolation: true},
+		"other kind of error": {Err: errDiskError},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for _, dialect := range []Dialect{MattnDialect{}, defaultDialect} {
+				if actual := dialect.IsConstraintViolation(testDefinition.Err); actual != testDefinition.ExpectedConstraintViolation {
+					t.Errorf("%T: want constraint violation %t, got %t", dialect, testDefinition.ExpectedConstraintViolation, actual)
+				}
+				if actual := dialect.IsBusy(testDefinition.Err); actual != testDefinition.ExpectedBusy {
+					t.Errorf("%T: want busy %t, got %t", dialect, testDefinition.ExpectedBusy, actual)
+				}
+				if actual := dialect.IsTransient(testDefinition.Err); actual != testDefinition.ExpectedTransient {
+					t.Errorf("%T: want transient %t, got %t", dialect, testDefinition.ExpectedTransient, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestMattnDialectDSN(t *testing.T) {
+	expected := "sessions.db?_busy_timeout=5000&_foreign_keys=1&_journal_mode=WAL&_synchronous=NORMAL"
+	if actual := (MattnDialect{}).dsn("sessions.db"); actual != expected {
+		t.Errorf("want DSN %q, got %q", expected, actual)
+	}
+	if actual := defaultDialect.(opener).dsn("sessions.db"); actual != expected {
+		t.Errorf("want the default dialect to use the DSN %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlitestore
+
+// defaultDialect recognizes the errors of modernc.org/sqlite, the only
+// supported driver that does not require cgo.
+var defaultDialect Dialect = ModerncDialect{}
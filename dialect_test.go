@@ -0,0 +1,76 @@
+package sqlitestore
+
+import (
+	"fmt"
+	"testing"
+)
+
+// codeError is an error carrying an SQLite result code, like the errors of
+// modernc.org/sqlite.
+type codeError int
+
+func (e codeError) Error() string {
+	return fmt.Sprintf("sqlite error %d", int(e))
+}
+
+func (e codeError) Code() int {
+	return int(e)
+}
+
+func TestModerncDialect(t *testing.T) {
+	const sqliteConstraintPrimaryKey = 1555
+	tests := map[string]struct {
+		Err                         error
+		ExpectedConstraintViolation bool
+		ExpectedBusy                bool
+		ExpectedTransient           bool
+	}{
+		"database is busy":             {Err: codeError(sqliteBusy), ExpectedBusy: true, ExpectedTransient: true},
+		"table is locked":              {Err: codeError(sqliteLocked), ExpectedBusy: true, ExpectedTransient: true},
+		"disk is full":                 {Err: codeError(sqliteFull), ExpectedTransient: true},
+		"constraint failed":            {Err: codeError(sqliteConstraint), ExpectedConstraintViolation: true},
+		"extended result code":         {Err: codeError(sqliteConstraintPrimaryKey), ExpectedConstraintViolation: true},
+		"wrapped error":                {Err: fmt.Errorf("wrapped: %w", codeError(sqliteBusy)), ExpectedBusy: true, ExpectedTransient: true},
+		"error without an SQLite code": {Err: errDiskError},
+		"no error":                     {Err: nil},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			dialect := ModerncDialect{}
+			if actual := dialect.IsConstraintViolation(testDefinition.Err); actual != testDefinition.ExpectedConstraintViolation {
+				t.Errorf("want constraint violation %t, got %t", testDefinition.ExpectedConstraintViolation, actual)
+			}
+			if actual := dialect.IsBusy(testDefinition.Err); actual != testDefinition.ExpectedBusy {
+				t.Errorf("want busy %t, got %t", testDefinition.ExpectedBusy, actual)
+			}
+			if actual := dialect.IsTransient(testDefinition.Err); actual != testDefinition.ExpectedTransient {
+				t.Errorf("want transient %t, got %t", testDefinition.ExpectedTransient, actual)
+			}
+		})
+	}
+}
+
+func TestModerncDialectDSN(t *testing.T) {
+	tests := map[string]struct {
+		Path     string
+		Expected string
+	}{
+		"path without parameters": {
+			Path:     "sessions.db",
+			Expected: "sessions.db?_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29&_pragma=synchronous%28NORMAL%29&_pragma=foreign_keys%281%29&_time_format=sqlite",
+		},
+		"URI with parameters": {
+			Path:     "file:sessions.db?mode=rwc",
+			Expected: "file:sessions.db?mode=rwc&_pragma=busy_timeout%285000%29&_pragma=journal_mode%28WAL%29&_pragma=synchronous%28NORMAL%29&_pragma=foreign_keys%281%29&_time_format=sqlite",
+		},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			if actual := (ModerncDialect{}).dsn(testDefinition.Path); actual != testDefinition.Expected {
+				t.Errorf("want DSN %q, got %q", testDefinition.Expected, actual)
+			}
+		})
+	}
+}
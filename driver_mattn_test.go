@@ -0,0 +1,22 @@
+//go:build cgo
+// +build cgo
+
+package sqlitestore_test
+
+import _ "github.com/mattn/go-sqlite3"
+
+// driverName is the name of the driver the integration tests run against.
+// Without cgo, they run against modernc.org/sqlite instead.
+const driverName = "sqlite3"
+
+// noBusyTimeout is the DSN parameter making writers fail at once when the
+// database is locked, instead of waiting for the lock.
+const noBusyTimeout = "_busy_timeout=0"
+
+// readOnly are the DSN parameters opening a database in read-only mode.
+const readOnly = "mode=ro&_query_only=1"
+
+// withDriverParams returns dsn with the parameters the driver needs.
+func withDriverParams(dsn string) string {
+	return dsn
+}
@@ -0,0 +1,37 @@
+//go:build !cgo
+// +build !cgo
+
+package sqlitestore_test
+
+import (
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// driverName is the name of the driver the integration tests run against.
+// With cgo, they run against github.com/mattn/go-sqlite3 instead.
+const driverName = "sqlite"
+
+// noBusyTimeout is the DSN parameter making writers fail at once when the
+// database is locked, instead of waiting for the lock.
+const noBusyTimeout = "_pragma=busy_timeout(0)"
+
+// readOnly are the DSN parameters opening a database in read-only mode.
+const readOnly = "mode=ro&_pragma=query_only(1)"
+
+// withDriverParams returns dsn with the parameters the driver needs: the
+// store expects timestamps in SQLite's format, and concurrent writers must
+// wait for each other like they do with github.com/mattn/go-sqlite3, unless
+// dsn sets its own busy timeout.
+func withDriverParams(dsn string) string {
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+	dsn += separator + "_time_format=sqlite"
+	if !strings.Contains(dsn, "busy_timeout") {
+		dsn += "&_pragma=busy_timeout(5000)"
+	}
+	return dsn
+}
@@ -0,0 +1,94 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/swithek/sessionup"
+)
+
+// LimitPolicy tells Create what to do when a user key would exceed the
+// session limit set with WithSessionLimit.
+type LimitPolicy int
+
+const (
+	// RejectNewSessions makes Create return a *SessionLimitError, keeping
+	// the existing sessions.
+	RejectNewSessions LimitPolicy = iota
+
+	// EvictOldestSessions makes Create delete the oldest sessions of the user
+	// key, so that the new session fits within the limit.
+	EvictOldestSessions
+)
+
+// SessionLimitError is returned by Create when the session limit of the user
+// key is reached and the store rejects new sessions.
+type SessionLimitError struct {
+	// UserKey is the user key of the rejected session.
+	UserKey string
+
+	// Limit is the maximum number of sessions per user key.
+	Limit int
+}
+
+func (e *SessionLimitError) Error() string {
+	return fmt.Sprintf("sqlitestore: user key %q reached the limit of %d sessions", e.UserKey, e.Limit)
+}
+
+// createWithinLimit inserts session, then enforces the session limit of its
+// user key in the same transaction.
+func (store *SqliteStore) createWithinLimit(ctx context.Context, session sessionup.Session) error {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint:errcheck // Rollback after Commit is a no-op
+
+	if err = store.insertWithinLimit(ctx, tx, session); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	store.uncacheEvicted(session)
+	return nil
+}
+
+// uncacheEvicted removes from the cache the sessions that may have been
+// evicted to make room for session.
+func (store *SqliteStore) uncacheEvicted(session sessionup.Session) {
+	if store.limitPolicy == EvictOldestSessions {
+		store.cache.removeUserKey(session.UserKey, session.ID)
+	}
+}
+
+// insertWithinLimit inserts session in tx, then enforces the session limit
+// of its user key. The insertion takes SQLite's write lock before the
+// sessions are counted, so concurrent logins are serialized and cannot
+// exceed the limit together. When the session is rejected, it is left
+// inserted in tx, which must be rolled back.
+func (store *SqliteStore) insertWithinLimit(ctx context.Context, tx *sql.Tx, session sessionup.Session) error {
+	err := store.insertSession(ctx, tx.StmtContext(ctx, store.stmt(createStatement)), session)
+	if err != nil {
+		return err
+	}
+
+	now := store.now()
+	var count int
+	row := tx.StmtContext(ctx, store.stmt(countByUserKeyStatement)).QueryRowContext(ctx, store.expiryArgs(now, session.UserKey)...)
+	if err = row.Scan(&count); err != nil {
+		return err
+	}
+
+	if excess := count - store.sessionLimit; excess > 0 {
+		if store.limitPolicy != EvictOldestSessions {
+			return &SessionLimitError{UserKey: session.UserKey, Limit: store.sessionLimit}
+		}
+		args := append(store.expiryArgs(now, session.UserKey, session.ID), excess)
+		if _, err = tx.StmtContext(ctx, store.stmt(evictOldestStatement)).ExecContext(ctx, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
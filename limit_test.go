@@ -0,0 +1,75 @@
+package sqlitestore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestCreateWithinLimit(t *testing.T) {
+	insertQuery := `INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	countQuery := `SELECT COUNT(*) FROM "sessions" WHERE user_key = $1 AND expires_at > $2;`
+	evictQuery := `DELETE FROM "sessions" WHERE rowid IN (SELECT rowid FROM "sessions" WHERE user_key = $1 AND id <> $2 AND expires_at > $3 ORDER BY created_at, rowid LIMIT $4);`
+	session := sessionup.Session{
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	expectInsert := func(mock sqlmock.Sqlmock) *sqlmock.ExpectedExec {
+		return mock.ExpectExec(insertQuery).WithArgs(
+			session.CreatedAt.UTC(), session.ExpiresAt.UTC(), session.ID, session.UserKey, nil, nil, nil, nil,
+		)
+	}
+
+	t.Run("commits the session when the limit is not exceeded", func(t *testing.T) {
+		store, mock := newMockStore(t, WithSessionLimit(2, RejectNewSessions))
+		mock.ExpectBegin()
+		expectInsert(mock).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(countQuery).WithArgs(session.UserKey, now.UTC()).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectCommit()
+		assertNoError(t, store.Create(context.Background(), session))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("rejects the session when the limit is exceeded", func(t *testing.T) {
+		store, mock := newMockStore(t, WithSessionLimit(2, RejectNewSessions))
+		mock.ExpectBegin()
+		expectInsert(mock).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(countQuery).WithArgs(session.UserKey, now.UTC()).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+		mock.ExpectRollback()
+		err := store.Create(context.Background(), session)
+		var limitError *SessionLimitError
+		if !errors.As(err, &limitError) {
+			t.Fatalf("want a *SessionLimitError, got %v", err)
+		}
+		if limitError.UserKey != session.UserKey || limitError.Limit != 2 {
+			t.Errorf("want the limit of 2 sessions of %q, got %v", session.UserKey, limitError)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("evicts the oldest sessions when the limit is exceeded", func(t *testing.T) {
+		store, mock := newMockStore(t, WithSessionLimit(2, EvictOldestSessions))
+		mock.ExpectBegin()
+		expectInsert(mock).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(countQuery).WithArgs(session.UserKey, now.UTC()).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+		mock.ExpectExec(evictQuery).WithArgs(session.UserKey, session.ID, now.UTC(), 2).WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+		assertNoError(t, store.Create(context.Background(), session))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("when the insertion fails, it should roll back and return the error", func(t *testing.T) {
+		store, mock := newMockStore(t, WithSessionLimit(2, EvictOldestSessions))
+		mock.ExpectBegin()
+		expectInsert(mock).WillReturnError(errDiskError)
+		mock.ExpectRollback()
+		assertError(t, errDiskError, store.Create(context.Background(), session))
+		assertExpectationsWereMet(t, mock)
+	})
+}
@@ -0,0 +1,50 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/swithek/sessionup"
+)
+
+// UpdateMeta changes the metadata of the session with the given ID in a
+// single statement, without recreating the session: the keys of set are
+// added or replaced, then the keys listed in unset are removed.
+// UpdateMeta returns false if no unexpired session has the given ID.
+func (store *SqliteStore) UpdateMeta(ctx context.Context, id string, set map[string]string, unset []string) (bool, error) {
+	// The patch is applied with json_patch, which removes the keys whose
+	// value is null.
+	patch := make(map[string]interface{}, len(set)+len(unset))
+	for key, value := range set {
+		patch[key] = value
+	}
+	for _, key := range unset {
+		patch[key] = nil
+	}
+	// A map of strings and nil values can always be marshaled.
+	serialized, _ := json.Marshal(patch)
+
+	var result sql.Result
+	err := store.retryBusy(ctx, func() (err error) {
+		args := store.expiryArgs(store.now(), string(serialized), id)
+		result, err = store.stmt(updateMetaStatement).ExecContext(ctx, args...)
+		return err
+	})
+	store.cache.remove(id)
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return updated > 0, nil
+}
+
+// FetchByMeta retrieves the unexpired sessions whose metadata maps key to
+// value. If none are found, it returns nil.
+// Metadata is not indexed, so every session is read.
+func (store *SqliteStore) FetchByMeta(ctx context.Context, key, value string) ([]sessionup.Session, error) {
+	return store.fetchSessions(ctx, store.readStmt(fetchByMetaStatement), store.expiryArgs(store.now(), key, value)...)
+}
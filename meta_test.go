@@ -0,0 +1,74 @@
+package sqlitestore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestUpdateMeta(t *testing.T) {
+	store, mock := newMockStore(t)
+	id := "id"
+	query := `UPDATE "sessions" SET metadata = NULLIF(json_patch(COALESCE(metadata, '{}'), $1), '{}') WHERE id = $2 AND expires_at > $3;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(`{"mfa_verified":"true"}`, id, now.UTC()).WillReturnError(errDiskError)
+		_, err := store.UpdateMeta(context.Background(), id, map[string]string{"mfa_verified": "true"}, nil)
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns false when there is no unexpired session with the ID", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(`{"mfa_verified":"true"}`, id, now.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+		updated, err := store.UpdateMeta(context.Background(), id, map[string]string{"mfa_verified": "true"}, nil)
+		assertNoError(t, err)
+		if updated {
+			t.Error("want updated = false, got true")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("sets keys and unsets keys with a JSON patch", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(`{"mfa_verified":"true","remember_me":null}`, id, now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		updated, err := store.UpdateMeta(context.Background(), id, map[string]string{"mfa_verified": "true"}, []string{"remember_me"})
+		assertNoError(t, err)
+		if !updated {
+			t.Error("want updated = true, got false")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestFetchByMeta(t *testing.T) {
+	store, mock := newMockStore(t)
+	query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = $1 AND value = $2) AND expires_at > $3;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectQuery(query).WithArgs("mfa_verified", "true", now.UTC()).WillReturnError(errDiskError)
+		_, err := store.FetchByMeta(context.Background(), "mfa_verified", "true")
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns the sessions carrying the metadata", func(t *testing.T) {
+		session := sessionup.Session{
+			ExpiresAt: now.UTC().Add(time.Hour),
+			ID:        "id",
+			UserKey:   "key",
+			Meta:      map[string]string{"mfa_verified": "true"},
+		}
+		rows := sqlmock.NewRows([]string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}).
+			AddRow(session.CreatedAt, session.ExpiresAt, session.ID, session.UserKey, nil, nil, nil, `{"mfa_verified":"true"}`)
+		mock.ExpectQuery(query).WithArgs("mfa_verified", "true", now.UTC()).WillReturnRows(rows)
+		sessions, err := store.FetchByMeta(context.Background(), "mfa_verified", "true")
+		assertNoError(t, err)
+		if expected := []sessionup.Session{session}; !reflect.DeepEqual(expected, sessions) {
+			t.Errorf("want %v, got %v", expected, sessions)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
@@ -0,0 +1,252 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the sessions table has been migrated by a
+// newer version of this package than the one in use.
+var ErrSchemaTooNew = errors.New("sqlitestore: sessions table schema is newer than supported")
+
+const createMigrationsTableQuery = `CREATE TABLE IF NOT EXISTS %s (
+	version INTEGER PRIMARY KEY,
+	applied_at DATETIME NOT NULL
+);`
+
+const createTableQuery = `CREATE TABLE IF NOT EXISTS %s (
+	created_at DATETIME NOT NULL,
+	expires_at DATETIME NOT NULL,
+	id TEXT PRIMARY KEY,
+	user_key TEXT NOT NULL,
+	ip TEXT,
+	agent_os TEXT,
+	agent_browser TEXT,
+	metadata TEXT
+);`
+
+// Separators of the legacy "key:value;" metadata format.
+//
+// Deprecated: metadata is now stored as a JSON object. These constants are
+// only kept to convert sessions written by older versions of this package.
+const (
+	PART_SEPARATOR      = ";"
+	KEY_VALUE_SEPARATOR = ":"
+)
+
+// migrationTx runs the queries of the migrations in the transaction opened
+// by migrate.
+type migrationTx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// migration upgrades the schema of the sessions table by one version.
+type migration func(ctx context.Context, tx migrationTx, table tableName) error
+
+// migrations lists the schema migrations in the order they must be applied.
+// The schema version of a sessions table is the number of migrations that
+// have been applied to it, so new migrations must only ever be appended.
+var migrations = []migration{
+	createSessionsTable,
+	convertLegacyMetadata,
+	convertTimestampsToUTC,
+	createIndexes,
+	createCreatedAtIndex,
+	addLastSeenColumns,
+}
+
+// schemaVersion is the schema version expected by this package.
+var schemaVersion = len(migrations)
+
+// migrate brings the sessions table up to date. Applied versions are recorded
+// in a companion "<table>_migrations" table. All pending migrations are
+// applied in a single transaction, so a failing migration leaves the schema
+// untouched.
+// The transaction takes the write lock before the version is read, so that
+// stores starting together on the same database wait for each other instead
+// of failing to upgrade their read lock. database/sql cannot begin such a
+// transaction, so it is run on a dedicated connection.
+func migrate(ctx context.Context, db *sql.DB, table tableName) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE;"); err != nil {
+		return err
+	}
+	if err = migrateInTx(ctx, conn, table); err != nil {
+		// The transaction must be rolled back even if ctx is done.
+		_, _ = conn.ExecContext(context.Background(), "ROLLBACK;")
+		return err
+	}
+	return nil
+}
+
+// migrateInTx applies the pending migrations in the transaction begun on
+// tx, then commits it.
+func migrateInTx(ctx context.Context, tx migrationTx, table tableName) error {
+	migrationsTable := table.withSuffix("_migrations")
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(createMigrationsTableQuery, migrationsTable))
+	if err != nil {
+		return err
+	}
+
+	var current int
+	query := fmt.Sprintf("SELECT COALESCE(MAX(version), 0) FROM %s;", migrationsTable)
+	if err = tx.QueryRowContext(ctx, query).Scan(&current); err != nil {
+		return err
+	}
+	if current > schemaVersion {
+		return fmt.Errorf("%w: table is at version %d, this package supports up to version %d", ErrSchemaTooNew, current, schemaVersion)
+	}
+
+	insertVersionQuery := fmt.Sprintf("INSERT INTO %s (version, applied_at) VALUES ($1, $2);", migrationsTable)
+	for version := current + 1; version <= schemaVersion; version++ {
+		if err = migrations[version-1](ctx, tx, table); err != nil {
+			return fmt.Errorf("sqlitestore: could not apply migration %d: %w", version, err)
+		}
+		if _, err = tx.ExecContext(ctx, insertVersionQuery, version, time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "COMMIT;")
+	return err
+}
+
+// createSessionsTable creates the sessions table. Tables created before
+// migrations were introduced already have this schema and are left as is.
+func createSessionsTable(ctx context.Context, tx migrationTx, table tableName) error {
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(createTableQuery, table))
+	return err
+}
+
+// convertLegacyMetadata rewrites metadata stored in the legacy "key:value;"
+// format as JSON objects.
+func convertLegacyMetadata(ctx context.Context, tx migrationTx, table tableName) error {
+	query := fmt.Sprintf("SELECT id, metadata FROM %s WHERE metadata IS NOT NULL;", table) // nolint:gosec // Concatenation is used for table name, not bound parameters
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	converted := make(map[string]sql.NullString)
+	for rows.Next() {
+		var id string
+		var metadata sql.NullString
+		if err = rows.Scan(&id, &metadata); err != nil {
+			return err
+		}
+		if _, err = parseMetadata(metadata); err == nil {
+			continue
+		}
+		converted[id] = serializeMetadata(parseLegacyMetadata(metadata.String))
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	updateQuery := fmt.Sprintf("UPDATE %s SET metadata = $1 WHERE id = $2;", table)
+	for id, metadata := range converted {
+		if _, err = tx.ExecContext(ctx, updateQuery, metadata, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseLegacyMetadata converts a legacy "key:value;" metadata string into a
+// map of strings.
+func parseLegacyMetadata(source string) map[string]string {
+	meta := make(map[string]string)
+	parts := strings.Split(source, PART_SEPARATOR)
+	for _, part := range parts {
+		keyValue := strings.Split(part, KEY_VALUE_SEPARATOR)
+		if len(keyValue) != 2 {
+			continue
+		}
+
+		meta[keyValue[0]] = keyValue[1]
+	}
+	return meta
+}
+
+// convertTimestampsToUTC rewrites timestamps stored in the server's time zone
+// by older versions of this package to UTC.
+func convertTimestampsToUTC(ctx context.Context, tx migrationTx, table tableName) error {
+	query := fmt.Sprintf("SELECT id, created_at, expires_at FROM %s WHERE created_at NOT LIKE '%%+00:00' OR expires_at NOT LIKE '%%+00:00';", table) // nolint:gosec // Concatenation is used for table name, not bound parameters
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type timestamps struct{ createdAt, expiresAt time.Time }
+	converted := make(map[string]timestamps)
+	for rows.Next() {
+		var id string
+		var current timestamps
+		if err = rows.Scan(&id, &current.createdAt, &current.expiresAt); err != nil {
+			return err
+		}
+		converted[id] = timestamps{current.createdAt.UTC(), current.expiresAt.UTC()}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	updateQuery := fmt.Sprintf("UPDATE %s SET created_at = $1, expires_at = $2 WHERE id = $3;", table)
+	for id, current := range converted {
+		if _, err = tx.ExecContext(ctx, updateQuery, current.createdAt, current.expiresAt, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes creates the indexes used to look sessions up by user key and
+// to find the expired sessions.
+func createIndexes(ctx context.Context, tx migrationTx, table tableName) error {
+	queries := []string{
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (user_key);", table.withSuffix("_user_key_idx"), table.unqualified()),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (expires_at);", table.withSuffix("_expires_at_idx"), table.unqualified()),
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createCreatedAtIndex creates the index used to find the sessions that
+// exceeded their maximum lifetime.
+func createCreatedAtIndex(ctx context.Context, tx migrationTx, table tableName) error {
+	query := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (created_at);", table.withSuffix("_created_at_idx"), table.unqualified())
+	_, err := tx.ExecContext(ctx, query)
+	return err
+}
+
+// addLastSeenColumns adds the columns recording when and from where each
+// session was last used.
+func addLastSeenColumns(ctx context.Context, tx migrationTx, table tableName) error {
+	queries := []string{
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN last_seen_at DATETIME;", table),
+		fmt.Sprintf("ALTER TABLE %s ADD COLUMN last_seen_ip TEXT;", table),
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
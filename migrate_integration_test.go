@@ -0,0 +1,295 @@
+package sqlitestore_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	sqlitestore "github.com/hyzual/sessionup-sqlitestore"
+	"github.com/swithek/sessionup"
+)
+
+func TestMigrationsIntegration(t *testing.T) {
+	t.Run("records the schema version of a new table", func(t *testing.T) {
+		db := openMigrationsDB(t)
+
+		_, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not create a new sessions table: %v", err)
+		}
+		firstVersion := schemaVersionOf(t, db)
+		if firstVersion == 0 {
+			t.Fatal("expected schema version to be recorded, but it was not")
+		}
+
+		_, err = sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not open an up-to-date sessions table: %v", err)
+		}
+		if secondVersion := schemaVersionOf(t, db); secondVersion != firstVersion {
+			t.Errorf("want schema version %d, got %d", firstVersion, secondVersion)
+		}
+	})
+
+	t.Run("adopts a table created before migrations were introduced", func(t *testing.T) {
+		db := openMigrationsDB(t)
+		createLegacySessionsTable(t, db)
+		_, err := db.Exec(
+			"INSERT INTO sessions VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+			time.Now(), time.Now().Add(time.Hour), "legacy", "key", "127.0.0.1", nil, nil, nil,
+		)
+		if err != nil {
+			t.Fatalf("could not insert a legacy session: %v", err)
+		}
+
+		store, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not migrate the legacy sessions table: %v", err)
+		}
+
+		retrievedSession, ok, err := store.FetchByID(context.Background(), "legacy")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the legacy session: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to find the legacy session after migration, but it was not found")
+		}
+		assertSessionEquals(t, retrievedSession, sessionup.Session{
+			ID:        "legacy",
+			UserKey:   "key",
+			CreatedAt: retrievedSession.CreatedAt,
+			ExpiresAt: retrievedSession.ExpiresAt,
+			IP:        net.ParseIP("127.0.0.1"),
+		})
+	})
+
+	t.Run("converts metadata written in the legacy format", func(t *testing.T) {
+		db := openMigrationsDB(t)
+		createLegacySessionsTable(t, db)
+		_, err := db.Exec(
+			"INSERT INTO sessions VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+			time.Now(), time.Now().Add(time.Hour), "legacy", "key", nil, nil, nil, "test:1;:val;",
+		)
+		if err != nil {
+			t.Fatalf("could not insert a legacy session: %v", err)
+		}
+
+		store, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not migrate the legacy sessions table: %v", err)
+		}
+
+		retrievedSession, ok, err := store.FetchByID(context.Background(), "legacy")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the legacy session: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to find the legacy session after migration, but it was not found")
+		}
+		expected := map[string]string{"test": "1", "": "val"}
+		if !reflect.DeepEqual(expected, retrievedSession.Meta) {
+			t.Errorf("got Meta %v, want %v", retrievedSession.Meta, expected)
+		}
+	})
+
+	t.Run("converts timestamps written in the server's time zone to UTC", func(t *testing.T) {
+		db := openMigrationsDB(t)
+		createLegacySessionsTable(t, db)
+		zone := time.FixedZone("UTC+14", 14*60*60)
+		validSession := sessionup.Session{
+			CreatedAt: time.Now().In(zone).Add(time.Minute * -30),
+			ExpiresAt: time.Now().In(zone).Add(time.Minute * 30),
+			ID:        "valid",
+			UserKey:   "key",
+		}
+		expiredSession := sessionup.Session{
+			CreatedAt: time.Now().In(zone).Add(time.Hour * -1),
+			ExpiresAt: time.Now().In(zone).Add(time.Minute * -30),
+			ID:        "expired",
+			UserKey:   "key",
+		}
+		for _, s := range []sessionup.Session{validSession, expiredSession} {
+			_, err := db.Exec(
+				"INSERT INTO sessions VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+				s.CreatedAt, s.ExpiresAt, s.ID, s.UserKey, nil, nil, nil, nil,
+			)
+			if err != nil {
+				t.Fatalf("could not insert a legacy session: %v", err)
+			}
+		}
+
+		store, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not migrate the legacy sessions table: %v", err)
+		}
+
+		retrievedSession, ok, err := store.FetchByID(context.Background(), "valid")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the legacy session: %v", err)
+		}
+		if !ok {
+			t.Fatal("expected to find the legacy session after migration, but it was not found")
+		}
+		assertSessionEquals(t, retrievedSession, validSession)
+		if retrievedSession.ExpiresAt.Location() != time.UTC {
+			t.Errorf("got ExpiresAt in %s, want UTC", retrievedSession.ExpiresAt.Location())
+		}
+
+		_, ok, err = store.FetchByID(context.Background(), "expired")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the expired legacy session: %v", err)
+		}
+		if ok {
+			t.Fatal("expected not to find the expired legacy session, but it was found")
+		}
+	})
+
+	t.Run("creates indexes on user key, expiration time and creation time", func(t *testing.T) {
+		db := openMigrationsDB(t)
+		createLegacySessionsTable(t, db)
+
+		_, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not migrate the legacy sessions table: %v", err)
+		}
+
+		for _, column := range []string{"user_key", "expires_at", "created_at"} {
+			var count int
+			query := "SELECT COUNT(*) FROM pragma_index_list('sessions') AS list, pragma_index_info(list.name) AS info WHERE info.name = $1;"
+			if err = db.QueryRow(query, column).Scan(&count); err != nil {
+				t.Fatalf("could not list the indexes of the sessions table: %v", err)
+			}
+			if count != 1 {
+				t.Errorf("expected %s to be indexed, but it was not", column)
+			}
+		}
+	})
+
+	t.Run("refuses a table migrated by a newer version", func(t *testing.T) {
+		db := openMigrationsDB(t)
+
+		_, err := sqlitestore.New(db, "sessions", 0)
+		if err != nil {
+			t.Fatalf("could not create a new sessions table: %v", err)
+		}
+		_, err = db.Exec("INSERT INTO sessions_migrations (version, applied_at) VALUES ($1, $2);", schemaVersionOf(t, db)+1, time.Now())
+		if err != nil {
+			t.Fatalf("could not record a future schema version: %v", err)
+		}
+
+		_, err = sqlitestore.New(db, "sessions", 0)
+		if !errors.Is(err, sqlitestore.ErrSchemaTooNew) {
+			t.Errorf("want %v, got %v", sqlitestore.ErrSchemaTooNew, err)
+		}
+	})
+}
+
+func TestConcurrentMigrationsIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dsn := withDriverParams(filepath.Join(dir, "sessions.db"))
+
+	setup, err := sql.Open(driverName, dsn)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer setup.Close()
+	if _, err = setup.Exec("PRAGMA journal_mode = WAL;"); err != nil {
+		t.Fatalf("could not enable write-ahead logging: %v", err)
+	}
+	// With the migrations table already there, the stores only need the
+	// write lock once they found the migrations to apply.
+	_, err = setup.Exec("CREATE TABLE sessions_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME NOT NULL);")
+	if err != nil {
+		t.Fatalf("could not create the migrations table: %v", err)
+	}
+
+	// Each store has its own database handle, like stores in separate
+	// processes starting together on a fresh database.
+	const stores = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, stores)
+	for i := 0; i < stores; i++ {
+		db, err := sql.Open(driverName, dsn)
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+			if err == nil {
+				err = store.Close(context.Background())
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("could not create a store concurrently: %v", err)
+		}
+	}
+	if version := schemaVersionOf(t, setup); version == 0 {
+		t.Error("expected schema version to be recorded, but it was not")
+	}
+}
+
+func openMigrationsDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open(driverName, withDriverParams("file:migrations.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	// Every connection to an in-memory database gets its own database.
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createLegacySessionsTable creates a sessions table the way it was created
+// before migrations were introduced.
+func createLegacySessionsTable(t *testing.T, db *sql.DB) {
+	t.Helper()
+
+	_, err := db.Exec(`CREATE TABLE sessions (
+		created_at DATETIME NOT NULL,
+		expires_at DATETIME NOT NULL,
+		id TEXT PRIMARY KEY,
+		user_key TEXT NOT NULL,
+		ip TEXT,
+		agent_os TEXT,
+		agent_browser TEXT,
+		metadata TEXT
+	);`)
+	if err != nil {
+		t.Fatalf("could not create a legacy sessions table: %v", err)
+	}
+}
+
+func schemaVersionOf(t *testing.T, db *sql.DB) int {
+	t.Helper()
+
+	var version int
+	err := db.QueryRow("SELECT MAX(version) FROM sessions_migrations;").Scan(&version)
+	if err != nil {
+		t.Fatalf("could not read the schema version: %v", err)
+	}
+	return version
+}
@@ -0,0 +1,94 @@
+package sqlitestore
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// openBusyTimeout is how long the connections opened by Open wait for the
+// database to be unlocked before failing.
+const openBusyTimeout = 5 * time.Second
+
+// opener is implemented by the dialects that can open a database for Open.
+type opener interface {
+	// driverName returns the name under which the driver is registered.
+	driverName() string
+
+	// dsn returns the data source name of the database at path, setting
+	// the pragmas recommended for the store on every connection.
+	dsn(path string) string
+}
+
+// Open opens the SQLite database at path and returns a store configured by
+// the given options, like NewWithOptions.
+// Every connection is set up for the store: the database uses write-ahead
+// logging so that readers do not block the writer, connections wait up to 5
+// seconds for the database to be unlocked, foreign keys are enforced and the
+// database is synced less often, which is safe with write-ahead logging.
+// The database is opened with github.com/mattn/go-sqlite3, or with
+// modernc.org/sqlite when cgo is disabled or when ModerncDialect is given
+// with WithDialect. modernc.org/sqlite must then be imported by the program.
+// The store owns the database: Close closes it.
+func Open(path string, opts ...Option) (*SqliteStore, error) {
+	o := newOptions(opts...)
+	d, ok := o.dialect.(opener)
+	if !ok {
+		return nil, fmt.Errorf("sqlitestore: cannot open a database with dialect %T", o.dialect)
+	}
+
+	db, err := sql.Open(d.driverName(), d.dsn(path))
+	if err != nil {
+		return nil, err
+	}
+	setPoolLimits(db, path)
+
+	store, err := setUpStore(db, o)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	store.ownsDB = true
+	return store, nil
+}
+
+// setPoolLimits sizes the connection pool of db for SQLite, which allows a
+// single writer at a time: more connections than processors would only wait
+// for each other. Connections are kept open, as opening one is costly. An
+// in-memory database only lives in its connection, so a single one is used.
+func setPoolLimits(db *sql.DB, path string) {
+	conns := runtime.NumCPU()
+	if conns < 2 {
+		conns = 2
+	}
+	if isInMemory(path) {
+		conns = 1
+	}
+	db.SetMaxOpenConns(conns)
+	db.SetMaxIdleConns(conns)
+	db.SetConnMaxLifetime(0)
+}
+
+// isInMemory reports whether path names an in-memory database that is not
+// shared between connections, such as ":memory:", "file::memory:" or
+// "file:sessions?mode=memory", with or without parameters. An empty path
+// opens a temporary database that is also private to its connection.
+func isInMemory(path string) bool {
+	if path == "" {
+		return true
+	}
+	inMemory := strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory")
+	return inMemory && !strings.Contains(path, "cache=shared")
+}
+
+// withParams appends the given URL query parameters to path.
+func withParams(path string, params url.Values) string {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return path + separator + params.Encode()
+}
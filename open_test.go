@@ -0,0 +1,58 @@
+package sqlitestore
+
+import (
+	"database/sql"
+	"runtime"
+	"testing"
+)
+
+// errorsOnlyDialect is a Dialect that cannot open a database.
+type errorsOnlyDialect struct {
+	Dialect
+}
+
+func TestOpen(t *testing.T) {
+	t.Run("when the dialect cannot open a database, it should return an error", func(t *testing.T) {
+		_, err := Open("sessions.db", WithDialect(errorsOnlyDialect{ModerncDialect{}}))
+		if err == nil {
+			t.Error("expected an error, but did not get one")
+		}
+	})
+}
+
+func TestSetPoolLimits(t *testing.T) {
+	conns := runtime.NumCPU()
+	if conns < 2 {
+		conns = 2
+	}
+	tests := map[string]struct {
+		Path     string
+		Expected int
+	}{
+		"database file":                   {Path: "sessions.db", Expected: conns},
+		"in-memory database":              {Path: ":memory:", Expected: 1},
+		"in-memory database with params":  {Path: ":memory:?_foreign_keys=1", Expected: 1},
+		"in-memory database URI":          {Path: "file::memory:", Expected: 1},
+		"in-memory database URI params":   {Path: "file::memory:?_journal_mode=WAL", Expected: 1},
+		"named in-memory database URI":    {Path: "file:sessions?mode=memory", Expected: 1},
+		"shared in-memory database URI":   {Path: "file::memory:?cache=shared", Expected: conns},
+		"shared named in-memory database": {Path: "file:sessions?mode=memory&cache=shared", Expected: conns},
+		"temporary database without path": {Path: "", Expected: 1},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			db, _ := mockDB(t)
+			defer db.Close()
+			setPoolLimits(db, testDefinition.Path)
+			assertMaxOpenConns(t, db, testDefinition.Expected)
+		})
+	}
+}
+
+func assertMaxOpenConns(t *testing.T, db *sql.DB, expected int) {
+	t.Helper()
+	if actual := db.Stats().MaxOpenConnections; actual != expected {
+		t.Errorf("want %d open connections at most, got %d", expected, actual)
+	}
+}
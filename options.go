@@ -0,0 +1,287 @@
+package sqlitestore
+
+import "time"
+
+const (
+	// DefaultTableName is the name of the sessions table used when
+	// WithTableName is not given.
+	DefaultTableName = "sessions"
+
+	// DefaultCleanupInterval is how often expired sessions are removed when
+	// WithCleanupInterval is not given.
+	DefaultCleanupInterval = 5 * time.Minute
+
+	// DefaultCleanupMaxBackoff is the longest the cleanup waits after failing
+	// because the database is locked or the disk is full, when
+	// WithCleanupMaxBackoff is not given.
+	DefaultCleanupMaxBackoff = time.Hour
+
+	// DefaultCleanupBatchSize is how many expired sessions are deleted at
+	// once when WithCleanupBatchSize is not given.
+	DefaultCleanupBatchSize = 1000
+
+	// DefaultCleanupBatchPause is how long the cleanup waits between two
+	// batches when WithCleanupBatchPause is not given.
+	DefaultCleanupBatchPause = 10 * time.Millisecond
+
+	// DefaultActivityThreshold is how old the last recorded activity of a
+	// session must be for RecordActivity to record it again, when
+	// WithActivityThreshold is not given.
+	DefaultActivityThreshold = time.Minute
+
+	// DefaultBusyRetries is how many times a write is tried again when the
+	// database is locked by another connection, when WithBusyRetry is not
+	// given.
+	DefaultBusyRetries = 5
+
+	// DefaultBusyRetryDelay is the delay before the first retry of a write
+	// when WithBusyRetry is not given.
+	DefaultBusyRetryDelay = 5 * time.Millisecond
+
+	// DefaultBusyRetryMaxDelay is the longest delay between two retries of a
+	// write when WithBusyRetry is not given.
+	DefaultBusyRetryMaxDelay = 200 * time.Millisecond
+)
+
+// Option configures a SqliteStore created by NewWithOptions.
+type Option func(*options)
+
+// options holds the configuration of a SqliteStore.
+type options struct {
+	tableName            string
+	cleanupInterval      time.Duration
+	cleanupMaxBackoff    time.Duration
+	cleanupBatchSize     int
+	cleanupBatchPause    time.Duration
+	cleanupResultHandler func(deleted int64)
+	cleanupErrorHandler  func(error)
+	cleanupErrorChannel  chan error
+	clock                Clock
+	dialect              Dialect
+	activityThreshold    time.Duration
+	slidingIdleTimeout   time.Duration
+	slidingThreshold     time.Duration
+	maxLifetime          time.Duration
+	sessionLimit         int
+	limitPolicy          LimitPolicy
+	busyRetries          int
+	busyRetryDelay       time.Duration
+	busyRetryMaxDelay    time.Duration
+	cacheSize            int
+	cacheTTL             time.Duration
+	negativeCacheSize    int
+	negativeCacheTTL     time.Duration
+}
+
+// newOptions returns the default configuration overridden by the given
+// options.
+func newOptions(opts ...Option) options {
+	o := options{
+		tableName:         DefaultTableName,
+		cleanupInterval:   DefaultCleanupInterval,
+		cleanupMaxBackoff: DefaultCleanupMaxBackoff,
+		cleanupBatchSize:  DefaultCleanupBatchSize,
+		cleanupBatchPause: DefaultCleanupBatchPause,
+		clock:             realClock{},
+		dialect:           defaultDialect,
+		activityThreshold: DefaultActivityThreshold,
+		busyRetries:       DefaultBusyRetries,
+		busyRetryDelay:    DefaultBusyRetryDelay,
+		busyRetryMaxDelay: DefaultBusyRetryMaxDelay,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTableName sets the name of the table that will be used for sessions.
+// If it does not exist, it will be created. The name can be qualified by the
+// name of an attached database, like "aux.sessions". It is quoted in every
+// query, so reserved words such as "order" and names such as "my-sessions"
+// can be used.
+func WithTableName(tableName string) Option {
+	return func(o *options) {
+		o.tableName = tableName
+	}
+}
+
+// WithCleanupInterval sets how often the cleanup function will be called to
+// remove the expired sessions. Setting it to 0 will prevent cleanup from
+// being activated.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.cleanupInterval = interval
+	}
+}
+
+// WithCleanupMaxBackoff sets the longest the cleanup waits before trying
+// again when the database is locked or the disk is full. After each such
+// failure, the delay before the next attempt doubles, starting from the
+// cleanup interval, until it reaches maxBackoff.
+func WithCleanupMaxBackoff(maxBackoff time.Duration) Option {
+	return func(o *options) {
+		o.cleanupMaxBackoff = maxBackoff
+	}
+}
+
+// WithCleanupBatchSize sets how many expired sessions are deleted at once.
+// Deleting in batches keeps SQLite's write lock short so that creating
+// sessions is not stalled while a large number of sessions is removed.
+// Setting it to 0 deletes all the expired sessions with a single statement.
+func WithCleanupBatchSize(size int) Option {
+	return func(o *options) {
+		o.cleanupBatchSize = size
+	}
+}
+
+// WithCleanupBatchPause sets how long the cleanup waits between two batches,
+// to let other writers take SQLite's write lock.
+func WithCleanupBatchPause(pause time.Duration) Option {
+	return func(o *options) {
+		o.cleanupBatchPause = pause
+	}
+}
+
+// WithCleanupResultHandler sets a function that is called after every run
+// of the automatic cleanup with the number of expired sessions that were
+// deleted, including when the run failed part way. It is called from the
+// cleanup goroutine and delays the next cleanup until it returns.
+func WithCleanupResultHandler(handler func(deleted int64)) Option {
+	return func(o *options) {
+		o.cleanupResultHandler = handler
+	}
+}
+
+// WithCleanupErrorHandler sets a function that is called with every error
+// produced during the automatic cleanup, for example to log it. It is called
+// from the cleanup goroutine and delays the next cleanup until it returns.
+func WithCleanupErrorHandler(handler func(error)) Option {
+	return func(o *options) {
+		o.cleanupErrorHandler = handler
+	}
+}
+
+// WithCleanupErrorChannel makes the errors produced during the automatic
+// cleanup available on the channel returned by CleanupErr. The channel can
+// hold size errors, further errors are dropped until it is drained.
+func WithCleanupErrorChannel(size int) Option {
+	return func(o *options) {
+		o.cleanupErrorChannel = make(chan error, size)
+	}
+}
+
+// WithClock sets the clock used to determine which sessions are expired and
+// to schedule the cleanup. It defaults to the wall clock.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		if clock != nil {
+			o.clock = clock
+		}
+	}
+}
+
+// WithDialect sets the Dialect used to interpret the errors of the SQLite
+// driver. It only needs to be given for drivers other than
+// github.com/mattn/go-sqlite3 and modernc.org/sqlite.
+func WithDialect(dialect Dialect) Option {
+	return func(o *options) {
+		if dialect != nil {
+			o.dialect = dialect
+		}
+	}
+}
+
+// WithActivityThreshold sets how old the last recorded activity of a session
+// must be for RecordActivity to record it again. It avoids writing to the
+// database on every request. Setting it to 0 records every activity.
+func WithActivityThreshold(threshold time.Duration) Option {
+	return func(o *options) {
+		o.activityThreshold = threshold
+	}
+}
+
+// WithSlidingExpiration makes FetchByID extend the sessions it finds when
+// they expire in less than threshold: their expiration time is pushed to the
+// current time plus idleTimeout, in the database and in the returned session.
+// Sessions that are not used for idleTimeout thus expire, which implements
+// idle timeouts on top of sessionup.Manager. Setting idleTimeout to 0, the
+// default, disables sliding expiration. Touch can be used to extend sessions
+// explicitly instead.
+func WithSlidingExpiration(idleTimeout, threshold time.Duration) Option {
+	return func(o *options) {
+		o.slidingIdleTimeout = idleTimeout
+		o.slidingThreshold = threshold
+	}
+}
+
+// WithMaxLifetime sets the maximum lifetime of sessions, measured from their
+// creation. Sessions older than maxLifetime are expired whatever their
+// expiration time, even when they are extended with WithSlidingExpiration or
+// Touch: they are neither fetched nor extended, and they are removed by the
+// cleanup. Fetched sessions expire at the end of their lifetime at the
+// latest. Setting it to 0, the default, disables the maximum lifetime.
+func WithMaxLifetime(maxLifetime time.Duration) Option {
+	return func(o *options) {
+		o.maxLifetime = maxLifetime
+	}
+}
+
+// WithSessionLimit caps the number of unexpired sessions of each user key.
+// When creating a session would exceed limit, Create follows policy: it
+// either returns a *SessionLimitError or deletes the oldest sessions of the
+// user key. Setting limit to 0, the default, allows any number of sessions.
+func WithSessionLimit(limit int, policy LimitPolicy) Option {
+	return func(o *options) {
+		o.sessionLimit = limit
+		o.limitPolicy = policy
+	}
+}
+
+// WithBusyRetry sets how writes are tried again when they fail because the
+// database is locked by another connection, as reported by the Dialect of
+// the store. A write is tried again up to retries times. The delay before
+// each retry doubles, starting from delay, up to maxDelay, and is randomized
+// so that concurrent writers do not retry in lockstep. Retries stop as soon
+// as the context of the write is done. Setting retries to 0 disables them.
+// Writes made in a transaction given to WithTx are never retried.
+func WithBusyRetry(retries int, delay, maxDelay time.Duration) Option {
+	return func(o *options) {
+		o.busyRetries = retries
+		o.busyRetryDelay = delay
+		o.busyRetryMaxDelay = maxDelay
+	}
+}
+
+// WithCache makes FetchByID keep up to size sessions in memory, evicting the
+// least recently used ones, so that the sessions used the most are not read
+// from the database on every call. A session is cached for ttl at most, and
+// never beyond its expiration time, or beyond the time it must be extended
+// when sliding expiration is enabled. Setting ttl to 0 caches sessions until
+// then.
+// The sessions changed or deleted through the store are removed from the
+// cache, the expired sessions are removed along with the cleanup. Sessions
+// changed by other means, such as another store or process using the same
+// table, are served from the cache until ttl ends. CacheStats reports how
+// the cache is used. Setting size to 0, the default, disables the cache.
+func WithCache(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.cacheSize = size
+		o.cacheTTL = ttl
+	}
+}
+
+// WithNegativeCache makes FetchByID remember up to size session IDs that it
+// did not find, evicting the least recently used ones, so that repeated
+// lookups of unknown IDs, such as random or stale cookies sent by bots, do
+// not query the database. An ID is remembered for ttl at most, which should
+// be short. It is forgotten as soon as Create or Rotate give it to a session
+// through the store. Sessions created by other means, such as another store
+// or process using the same table, are not found until ttl ends.
+// Setting size or ttl to 0, the default, disables the negative cache.
+func WithNegativeCache(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.negativeCacheSize = size
+		o.negativeCacheTTL = ttl
+	}
+}
@@ -0,0 +1,46 @@
+package sqlitestore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewOptions(t *testing.T) {
+	t.Run("without options, it will return the defaults", func(t *testing.T) {
+		o := newOptions()
+		if o.tableName != DefaultTableName {
+			t.Errorf("want table name %q, got %q", DefaultTableName, o.tableName)
+		}
+		if o.cleanupInterval != DefaultCleanupInterval {
+			t.Errorf("want cleanup interval %s, got %s", DefaultCleanupInterval, o.cleanupInterval)
+		}
+		if _, ok := o.clock.(realClock); !ok {
+			t.Errorf("want the wall clock, got %T", o.clock)
+		}
+	})
+
+	t.Run("given options, it will override the defaults", func(t *testing.T) {
+		clock := stoppedClock{now}
+		o := newOptions(
+			WithTableName("user_sessions"),
+			WithCleanupInterval(0),
+			WithClock(clock),
+		)
+		if o.tableName != "user_sessions" {
+			t.Errorf("want table name %q, got %q", "user_sessions", o.tableName)
+		}
+		if o.cleanupInterval != 0 {
+			t.Errorf("want cleanup interval %s, got %s", time.Duration(0), o.cleanupInterval)
+		}
+		if o.clock != clock {
+			t.Errorf("want clock %v, got %v", clock, o.clock)
+		}
+	})
+
+	t.Run("given a nil clock, it will keep the wall clock", func(t *testing.T) {
+		o := newOptions(WithClock(nil))
+		if _, ok := o.clock.(realClock); !ok {
+			t.Errorf("want the wall clock, got %T", o.clock)
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package sqlitestore
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// retryBusy calls op until it succeeds, fails for a reason other than the
+// database being locked, or the retries set with WithBusyRetry are
+// exhausted. It waits between two calls, unless ctx is done first, in which
+// case the last error of op is returned.
+func (store *SqliteStore) retryBusy(ctx context.Context, op func() error) error {
+	err := op()
+	for retry := 0; retry < store.busyRetries && store.dialect.IsBusy(err); retry++ {
+		if !sleepContext(ctx, busyRetryDelay(store.busyRetryDelay, store.busyRetryMaxDelay, retry)) {
+			return err
+		}
+		err = op()
+	}
+	return err
+}
+
+// busyRetryDelay returns how long to wait before the given retry, counted
+// from 0. The delay doubles with each retry, up to maxDelay, and a random
+// part of up to half of it is taken off so that concurrent writers spread
+// their retries.
+func busyRetryDelay(delay, maxDelay time.Duration, retry int) time.Duration {
+	for i := 0; i < retry && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay || delay <= 0 {
+		delay = maxDelay
+	}
+	if half := delay / 2; half > 0 {
+		delay -= time.Duration(rand.Int63n(int64(half) + 1))
+	}
+	return delay
+}
+
+// sleepContext waits for d. It returns false if ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
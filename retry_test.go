@@ -0,0 +1,116 @@
+package sqlitestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestRetryBusy(t *testing.T) {
+	query := `DELETE FROM "sessions" WHERE id = $1;`
+	errBusy := codeError(sqliteBusy)
+	errLocked := codeError(sqliteLocked)
+
+	t.Run("retries while the database is locked", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(3, time.Millisecond, time.Millisecond))
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errBusy)
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errLocked)
+		mock.ExpectExec(query).WithArgs("id").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		assertNoError(t, store.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns the error once the retries are exhausted", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(2, time.Millisecond, time.Millisecond))
+		for i := 0; i < 3; i++ {
+			mock.ExpectExec(query).WithArgs("id").WillReturnError(errBusy)
+		}
+
+		assertError(t, errBusy, store.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(3, time.Millisecond, time.Millisecond))
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errDiskError)
+
+		assertError(t, errDiskError, store.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("stops retrying when the context is done", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(3, time.Hour, time.Hour))
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errBusy)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+
+		assertError(t, errBusy, store.DeleteByID(ctx, "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("does not retry when retries are disabled", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(0, time.Millisecond, time.Millisecond))
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errBusy)
+
+		assertError(t, errBusy, store.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("retries the whole transaction of Rotate", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(3, time.Millisecond, time.Millisecond))
+		expiresAt := now.Add(time.Hour)
+		rotateQuery := `INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip) SELECT created_at, $1, $2, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip FROM "sessions" WHERE id = $3 AND expires_at > $4;`
+		mock.ExpectBegin()
+		mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec(query).WithArgs("old").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit().WillReturnError(errBusy)
+		mock.ExpectBegin()
+		mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec(query).WithArgs("old").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		rotated, err := store.Rotate(context.Background(), "old", "new", expiresAt)
+		assertNoError(t, err)
+		if !rotated {
+			t.Error("want the session to be rotated")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("does not retry in a transaction", func(t *testing.T) {
+		store, mock := newMockStore(t, WithBusyRetry(3, time.Millisecond, time.Millisecond))
+		mock.ExpectBegin()
+		tx, err := store.db.Begin()
+		assertNoError(t, err)
+		mock.ExpectExec(query).WithArgs("id").WillReturnError(errBusy)
+
+		var txStore sessionup.Store = store.WithTx(tx)
+		assertError(t, errBusy, txStore.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestBusyRetryDelay(t *testing.T) {
+	tests := map[string]struct {
+		Retry    int
+		Expected time.Duration
+	}{
+		"starts from the delay":           {Retry: 0, Expected: time.Millisecond * 10},
+		"doubles the delay on each retry": {Retry: 2, Expected: time.Millisecond * 40},
+		"does not exceed the maximum":     {Retry: 10, Expected: time.Second},
+		"does not overflow":               {Retry: 100, Expected: time.Second},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			actual := busyRetryDelay(time.Millisecond*10, time.Second, testDefinition.Retry)
+			if actual < testDefinition.Expected/2 || actual > testDefinition.Expected {
+				t.Errorf("want a delay between %s and %s, got %s", testDefinition.Expected/2, testDefinition.Expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Package sqlitestoretest provides helpers to test code that uses sqlitestore.
+*/
+package sqlitestoretest
+
+import (
+	"sync"
+	"time"
+
+	sqlitestore "github.com/hyzual/sessionup-sqlitestore"
+)
+
+// FakeClock is a sqlitestore.Clock whose time only moves when Advance is
+// called. It lets tests expire sessions and trigger the automatic cleanup
+// without waiting.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock returns a FakeClock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements sqlitestore.Clock interface's Now method.
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+// NewTicker implements sqlitestore.Clock interface's NewTicker method.
+// The returned ticker only ticks when the clock is advanced.
+func (clock *FakeClock) NewTicker(d time.Duration) sqlitestore.Ticker {
+	if d <= 0 {
+		panic("sqlitestoretest: non-positive interval for NewTicker")
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	ticker := &fakeTicker{
+		clock:    clock,
+		c:        make(chan time.Time),
+		stopped:  make(chan struct{}),
+		interval: d,
+		next:     clock.now.Add(d),
+	}
+	clock.tickers = append(clock.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d. Every ticker whose interval has
+// elapsed ticks once, like a time.Ticker drops ticks for slow receivers.
+// Advance blocks until each tick has been received or its ticker stopped, so
+// when it returns the receivers are guaranteed to have seen the tick.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	clock.now = clock.now.Add(d)
+	now := clock.now
+	var due []*fakeTicker
+	for _, ticker := range clock.tickers {
+		if ticker.next.After(now) {
+			continue
+		}
+		for !ticker.next.After(now) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+		due = append(due, ticker)
+	}
+	clock.mu.Unlock()
+
+	for _, ticker := range due {
+		select {
+		case ticker.c <- now:
+		case <-ticker.stopped:
+		}
+	}
+}
+
+// remove forgets the given ticker so that it no longer ticks.
+func (clock *FakeClock) remove(ticker *fakeTicker) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for i, current := range clock.tickers {
+		if current == ticker {
+			clock.tickers = append(clock.tickers[:i], clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
+
+// fakeTicker is a sqlitestore.Ticker driven by a FakeClock.
+type fakeTicker struct {
+	clock    *FakeClock
+	c        chan time.Time
+	stopped  chan struct{}
+	stopOnce sync.Once
+	interval time.Duration
+	next     time.Time
+}
+
+func (ticker *fakeTicker) C() <-chan time.Time {
+	return ticker.c
+}
+
+func (ticker *fakeTicker) Stop() {
+	ticker.stopOnce.Do(func() {
+		close(ticker.stopped)
+		ticker.clock.remove(ticker)
+	})
+}
@@ -0,0 +1,70 @@
+package sqlitestoretest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2021, time.November, 8, 10, 0, 0, 0, time.UTC)
+
+	t.Run("only moves when advanced", func(t *testing.T) {
+		clock := NewFakeClock(start)
+		if !clock.Now().Equal(start) {
+			t.Errorf("want %s, got %s", start, clock.Now())
+		}
+
+		clock.Advance(time.Hour)
+		if expected := start.Add(time.Hour); !clock.Now().Equal(expected) {
+			t.Errorf("want %s, got %s", expected, clock.Now())
+		}
+	})
+
+	t.Run("ticks once the interval has elapsed", func(t *testing.T) {
+		clock := NewFakeClock(start)
+		ticker := clock.NewTicker(time.Minute)
+		defer ticker.Stop()
+		ticks := make(chan time.Time, 10)
+		go func() {
+			for tick := range ticker.C() {
+				ticks <- tick
+			}
+		}()
+
+		clock.Advance(time.Second * 30)
+		assertNoTick(t, ticks)
+
+		clock.Advance(time.Second * 30)
+		if tick := <-ticks; !tick.Equal(start.Add(time.Minute)) {
+			t.Errorf("want tick at %s, got %s", start.Add(time.Minute), tick)
+		}
+
+		clock.Advance(time.Hour)
+		<-ticks
+		assertNoTick(t, ticks)
+	})
+
+	t.Run("does not tick or block once the ticker is stopped", func(t *testing.T) {
+		clock := NewFakeClock(start)
+		ticker := clock.NewTicker(time.Minute)
+		ticker.Stop()
+		ticker.Stop()
+
+		clock.Advance(time.Hour)
+		select {
+		case <-ticker.C():
+			t.Error("expected no tick after the ticker was stopped, but got one")
+		default:
+		}
+	})
+}
+
+func assertNoTick(t *testing.T, ticks <-chan time.Time) {
+	t.Helper()
+
+	select {
+	case tick := <-ticks:
+		t.Errorf("expected no tick, got one at %s", tick)
+	default:
+	}
+}
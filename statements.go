@@ -0,0 +1,162 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sessionColumns lists the columns of the sessions table that make up a
+// sessionup.Session, in the order scanSession reads them.
+const sessionColumns = "created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata"
+
+// statement identifies one of the statements a store prepares once and reuses
+// across calls.
+type statement int
+
+const (
+	createStatement statement = iota
+	fetchByIDStatement
+	fetchByUserKeyStatement
+	fetchAllByUserKeyStatement
+	touchStatement
+	extendStatement
+	recordActivityStatement
+	fetchActivityByUserKeyStatement
+	countByUserKeyStatement
+	evictOldestStatement
+	rotateStatement
+	updateMetaStatement
+	fetchByMetaStatement
+	deleteByIDStatement
+	deleteByUserKeyStatement
+	deleteExpiredStatement
+	statementsCount
+)
+
+// readOnlyStatements lists the statements that only read sessions. When the
+// store has a read pool, they are prepared on it.
+var readOnlyStatements = [...]statement{
+	fetchByIDStatement,
+	fetchByUserKeyStatement,
+	fetchAllByUserKeyStatement,
+	fetchActivityByUserKeyStatement,
+	fetchByMetaStatement,
+}
+
+// queries returns the SQL of each statement of the store.
+func (store *SqliteStore) queries() [statementsCount]string {
+	table := store.table
+	expired, limit, evictLimit := "expires_at < $1", "$2", "$4"
+	if store.maxLifetime > 0 {
+		expired, limit, evictLimit = "(expires_at < $1 OR created_at < $2)", "$3", "$5"
+	}
+	deleteExpiredQuery := fmt.Sprintf("DELETE FROM %s WHERE %s;", table, expired)
+	if store.cleanupBatchSize > 0 {
+		deleteExpiredQuery = fmt.Sprintf("DELETE FROM %[1]s WHERE rowid IN (SELECT rowid FROM %[1]s WHERE %[2]s LIMIT %[3]s);", table, expired, limit)
+	}
+
+	return [statementsCount]string{
+		createStatement:                 fmt.Sprintf("INSERT INTO %s (%s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);", table, sessionColumns),
+		fetchByIDStatement:              fmt.Sprintf("SELECT %s FROM %s WHERE id = $1 AND %s;", sessionColumns, table, store.unexpired(2)),       // nolint:gosec // Concatenation is used for table name, not bound parameters
+		fetchByUserKeyStatement:         fmt.Sprintf("SELECT %s FROM %s WHERE user_key = $1 AND %s;", sessionColumns, table, store.unexpired(2)), // nolint:gosec // Concatenation is used for table name, not bound parameters
+		fetchAllByUserKeyStatement:      fmt.Sprintf("SELECT %s FROM %s WHERE user_key = $1;", sessionColumns, table),                            // nolint:gosec // Concatenation is used for table name, not bound parameters
+		touchStatement:                  fmt.Sprintf("UPDATE %s SET expires_at = $1 WHERE id = $2 AND %s;", table, store.unexpired(3)),
+		extendStatement:                 fmt.Sprintf("UPDATE %s SET expires_at = $1 WHERE id = $2 AND %s AND expires_at < $1;", table, store.unexpired(3)),
+		recordActivityStatement:         fmt.Sprintf("UPDATE %s SET last_seen_at = $1, last_seen_ip = $2 WHERE id = $3 AND (last_seen_at IS NULL OR last_seen_at < $4) AND %s;", table, store.unexpired(5)),
+		fetchActivityByUserKeyStatement: fmt.Sprintf("SELECT %s, last_seen_at, last_seen_ip FROM %s WHERE user_key = $1 AND %s;", sessionColumns, table, store.unexpired(2)), // nolint:gosec // Concatenation is used for table name, not bound parameters
+		countByUserKeyStatement:         fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE user_key = $1 AND %s;", table, store.unexpired(2)),
+		evictOldestStatement:            fmt.Sprintf("DELETE FROM %[1]s WHERE rowid IN (SELECT rowid FROM %[1]s WHERE user_key = $1 AND id <> $2 AND %[2]s ORDER BY created_at, rowid LIMIT %[3]s);", table, store.unexpired(3), evictLimit),
+		rotateStatement:                 fmt.Sprintf("INSERT INTO %[1]s (%[2]s, last_seen_at, last_seen_ip) SELECT created_at, $1, $2, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip FROM %[1]s WHERE id = $3 AND %[3]s;", table, sessionColumns, store.unexpired(4)),
+		updateMetaStatement:             fmt.Sprintf("UPDATE %s SET metadata = NULLIF(json_patch(COALESCE(metadata, '{}'), $1), '{}') WHERE id = $2 AND %s;", table, store.unexpired(3)),
+		fetchByMetaStatement:            fmt.Sprintf("SELECT %s FROM %s WHERE EXISTS (SELECT 1 FROM json_each(metadata) WHERE key = $1 AND value = $2) AND %s;", sessionColumns, table, store.unexpired(3)), // nolint:gosec // Concatenation is used for table name, not bound parameters
+		deleteByIDStatement:             fmt.Sprintf("DELETE FROM %s WHERE id = $1;", table),
+		deleteByUserKeyStatement:        fmt.Sprintf("DELETE FROM %s WHERE user_key = $1;", table),
+		deleteExpiredStatement:          deleteExpiredQuery,
+	}
+}
+
+// unexpired returns the condition selecting the sessions that are not
+// expired, the current time being bound to parameter $n. With a maximum
+// lifetime, the oldest creation time allowed is bound to parameter $n+1.
+// The parameters are given by expiryArgs.
+// SQLite numbers parameters in the order they first appear in a query, so
+// they must appear in ascending order.
+func (store *SqliteStore) unexpired(n int) string {
+	if store.maxLifetime <= 0 {
+		return fmt.Sprintf("expires_at > $%d", n)
+	}
+	return fmt.Sprintf("expires_at > $%d AND created_at > $%d", n, n+1)
+}
+
+// expiryArgs appends to args the parameters of the conditions telling
+// whether sessions are expired at now.
+func (store *SqliteStore) expiryArgs(now time.Time, args ...interface{}) []interface{} {
+	args = append(args, now)
+	if store.maxLifetime > 0 {
+		args = append(args, now.Add(-store.maxLifetime))
+	}
+	return args
+}
+
+// prepareStatements prepares every statement of the store.
+// database/sql transparently prepares them again on new connections, for
+// example when a connection is lost, so they stay usable until the store is
+// closed.
+// When the store has a read pool, the read-only statements are also prepared
+// on it.
+func (store *SqliteStore) prepareStatements(ctx context.Context) error {
+	queries := store.queries()
+	for i, query := range queries {
+		stmt, err := store.db.PrepareContext(ctx, query)
+		if err != nil {
+			_ = store.closeStatements()
+			return fmt.Errorf("sqlitestore: could not prepare statement %q: %w", query, err)
+		}
+		store.statements[i] = stmt
+	}
+
+	if store.readDB == nil {
+		return nil
+	}
+	for _, s := range readOnlyStatements {
+		stmt, err := store.readDB.PrepareContext(ctx, queries[s])
+		if err != nil {
+			_ = store.closeStatements()
+			return fmt.Errorf("sqlitestore: could not prepare statement %q on the read pool: %w", queries[s], err)
+		}
+		store.readStatements[s] = stmt
+	}
+	return nil
+}
+
+// stmt returns the prepared statement s.
+func (store *SqliteStore) stmt(s statement) *sql.Stmt {
+	return store.statements[s]
+}
+
+// readStmt returns the prepared statement s, from the read pool if the store
+// has one and s only reads sessions.
+func (store *SqliteStore) readStmt(s statement) *sql.Stmt {
+	if stmt := store.readStatements[s]; stmt != nil {
+		return stmt
+	}
+	return store.statements[s]
+}
+
+// closeStatements releases every prepared statement of the store.
+func (store *SqliteStore) closeStatements() error {
+	var firstErr error
+	for _, stmts := range [][statementsCount]*sql.Stmt{store.statements, store.readStatements} {
+		for _, stmt := range stmts {
+			if stmt == nil {
+				continue
+			}
+			if err := stmt.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -6,67 +6,234 @@ package sqlitestore
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
-	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/swithek/sessionup"
 )
 
-const createTableQuery = `CREATE TABLE IF NOT EXISTS %s (
-	created_at DATETIME NOT NULL,
-	expires_at DATETIME NOT NULL,
-	id TEXT PRIMARY KEY,
-	user_key TEXT NOT NULL,
-	ip TEXT,
-	agent_os TEXT,
-	agent_browser TEXT,
-	metadata TEXT
-);`
-
-const (
-	PART_SEPARATOR      = ";"
-	KEY_VALUE_SEPARATOR = ":"
-)
-
 // SqliteStore is a SQLite implementation of sessionup.Store.
 type SqliteStore struct {
-	db        *sql.DB
-	tableName string
-	stopChan  chan struct{}
-	errChan   chan error
+	db             *sql.DB
+	readDB         *sql.DB
+	ownsDB         bool
+	table          tableName
+	clock          Clock
+	dialect        Dialect
+	statements     [statementsCount]*sql.Stmt
+	readStatements [statementsCount]*sql.Stmt
+	cache          *sessionCache
+	unknownIDs     *sessionCache
+	closeOnce      sync.Once
+	closeErr       error
+
+	activityThreshold  time.Duration
+	slidingIdleTimeout time.Duration
+	slidingThreshold   time.Duration
+	maxLifetime        time.Duration
+	sessionLimit       int
+	limitPolicy        LimitPolicy
+	busyRetries        int
+	busyRetryDelay     time.Duration
+	busyRetryMaxDelay  time.Duration
+
+	cleanupInterval   time.Duration
+	cleanupMaxBackoff time.Duration
+	cleanupBatchSize  int
+	cleanupBatchPause time.Duration
+	cleanupFailures   int32
+	resultHandler     func(deleted int64)
+	errHandler        func(error)
+	errChan           chan error
+	stopChan          chan struct{}
+	doneChan          chan struct{}
+	stopOnce          sync.Once
 }
 
 // New returns a fresh instance of SqliteStore.
 // tableName parameter determines the name of the table that will be used for
-// sessions. If it does not exist, it will be created.
+// sessions. If it does not exist, it will be created. If it was created by an
+// older version of this package, its schema will be migrated. New returns an
+// error wrapping ErrSchemaTooNew if the table was migrated by a newer version
+// of this package, or an *InvalidTableNameError if tableName is not a valid
+// identifier.
 // Duration parameter determines how often the cleanup function wil be called
 // to remove the expired sessions. Setting it to 0 will prevent cleanup from
 // being activated.
+// Errors produced during the cleanup are sent to the channel returned by
+// CleanupErr.
+// New is a shorthand for NewWithOptions with WithTableName,
+// WithCleanupInterval and WithCleanupErrorChannel.
 func New(db *sql.DB, tableName string, duration time.Duration) (*SqliteStore, error) {
-	store := &SqliteStore{db: db, tableName: tableName, errChan: make(chan error)}
-	_, err := store.db.Exec(fmt.Sprintf(createTableQuery, store.tableName))
+	return NewWithOptions(
+		db,
+		WithTableName(tableName),
+		WithCleanupInterval(duration),
+		WithCleanupErrorChannel(1),
+	)
+}
+
+// NewWithOptions returns a fresh instance of SqliteStore configured by the
+// given options. Without options, sessions are stored in DefaultTableName and
+// cleaned up every DefaultCleanupInterval.
+// The sessions table is created or migrated like in New.
+func NewWithOptions(db *sql.DB, opts ...Option) (*SqliteStore, error) {
+	return setUpStore(db, newOptions(opts...))
+}
+
+// NewWithPools returns a fresh instance of SqliteStore that reads sessions
+// with readDB and writes them with writeDB. It is configured by the given
+// options and creates or migrates the sessions table like NewWithOptions.
+// SQLite allows many readers but a single writer at a time. writeDB should
+// be limited to one connection, so that writers queue in the pool rather
+// than contend for the lock of the database. readDB should be opened
+// read-only, for example with "mode=ro" and the query_only pragma, and can
+// have many connections: with write-ahead logging, they read sessions
+// without waiting behind writers.
+// Only the fetches use readDB. FetchByID extends sessions with writeDB, and
+// the transactions given to WithTx must be started on writeDB.
+func NewWithPools(readDB, writeDB *sql.DB, opts ...Option) (*SqliteStore, error) {
+	store, err := newStore(writeDB, newOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
+	store.readDB = readDB
+	return store.setUp()
+}
+
+// setUpStore returns a SqliteStore configured by o, whose table is migrated,
+// whose statements are prepared and whose cleanup is started.
+func setUpStore(db *sql.DB, o options) (*SqliteStore, error) {
+	store, err := newStore(db, o)
+	if err != nil {
+		return nil, err
+	}
+	return store.setUp()
+}
+
+// setUp migrates the table of store, prepares its statements and starts its
+// cleanup. The migration is retried while the database is locked, like the
+// writes of the store.
+func (store *SqliteStore) setUp() (*SqliteStore, error) {
+	ctx := context.Background()
+	err := store.retryBusy(ctx, func() error {
+		return migrate(ctx, store.db, store.table)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = store.prepareStatements(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if duration > 0 {
-		go store.startCleanup(duration)
+	if store.cleanupInterval > 0 {
+		// The ticker is created before starting the cleanup so that no tick
+		// can be missed, which matters when the clock is a fake.
+		store.startCleanup(store.clock.NewTicker(store.cleanupInterval))
 	}
 	return store, nil
 }
 
+// newStore returns a SqliteStore configured by o. Its table is neither
+// migrated nor are its statements prepared.
+func newStore(db *sql.DB, o options) (*SqliteStore, error) {
+	table, err := parseTableName(o.tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SqliteStore{
+		db:                 db,
+		table:              table,
+		clock:              o.clock,
+		cache:              newSessionCache(o.cacheSize, o.cacheTTL),
+		unknownIDs:         newNegativeCache(o.negativeCacheSize, o.negativeCacheTTL),
+		dialect:            o.dialect,
+		activityThreshold:  o.activityThreshold,
+		slidingIdleTimeout: o.slidingIdleTimeout,
+		slidingThreshold:   o.slidingThreshold,
+		maxLifetime:        o.maxLifetime,
+		sessionLimit:       o.sessionLimit,
+		limitPolicy:        o.limitPolicy,
+		busyRetries:        o.busyRetries,
+		busyRetryDelay:     o.busyRetryDelay,
+		busyRetryMaxDelay:  o.busyRetryMaxDelay,
+		cleanupInterval:    o.cleanupInterval,
+		cleanupMaxBackoff:  o.cleanupMaxBackoff,
+		cleanupBatchSize:   o.cleanupBatchSize,
+		cleanupBatchPause:  o.cleanupBatchPause,
+		resultHandler:      o.cleanupResultHandler,
+		errHandler:         o.cleanupErrorHandler,
+		errChan:            o.cleanupErrorChannel,
+	}, nil
+}
+
+// Close terminates the automatic cleanup process like StopCleanup, then
+// releases the prepared statements of the store. If ctx is done before the
+// cleanup in progress finishes, Close returns ctx.Err() and the statements
+// are released once the cleanup is over.
+// Close can safely be called several times. It does not close the database,
+// unless the store was created by Open.
+// The store must not be used after it is closed.
+func (store *SqliteStore) Close(ctx context.Context) error {
+	if err := store.stopCleanup(ctx); err != nil {
+		go func() {
+			<-store.doneChan
+			_ = store.releaseOnce()
+		}()
+		return err
+	}
+	return store.releaseOnce()
+}
+
+// releaseOnce releases the prepared statements of the store, and the
+// database if the store owns it, the first time it is called. It returns the
+// same result on every call.
+func (store *SqliteStore) releaseOnce() error {
+	store.closeOnce.Do(func() {
+		store.closeErr = store.closeStatements()
+		if store.ownsDB {
+			if err := store.db.Close(); store.closeErr == nil {
+				store.closeErr = err
+			}
+		}
+	})
+	return store.closeErr
+}
+
+// DB returns the database of the store, for example to begin the
+// transactions given to WithTx when the store was created by Open.
+func (store *SqliteStore) DB() *sql.DB {
+	return store.db
+}
+
 // Create implements sessionup.Store interface's Create method.
+// When a session limit is set with WithSessionLimit, Create enforces it in
+// the same transaction as the insertion of the session.
 func (store *SqliteStore) Create(ctx context.Context, session sessionup.Session) error {
-	query := fmt.Sprintf("INSERT INTO %s VALUES ($1, $2, $3, $4, $5, $6, $7, $8);", store.tableName)
-	_, err := store.db.ExecContext(
+	err := store.retryBusy(ctx, func() error {
+		if store.sessionLimit > 0 {
+			return store.createWithinLimit(ctx, session)
+		}
+		return store.insertSession(ctx, store.stmt(createStatement), session)
+	})
+	store.unknownIDs.remove(session.ID)
+	return err
+}
+
+// insertSession inserts session with the given create statement.
+func (store *SqliteStore) insertSession(ctx context.Context, stmt *sql.Stmt, session sessionup.Session) error {
+	_, err := stmt.ExecContext(
 		ctx,
-		query,
-		session.CreatedAt,
-		session.ExpiresAt,
+		session.CreatedAt.UTC(),
+		session.ExpiresAt.UTC(),
 		session.ID,
 		session.UserKey,
 		wrapNullString(session.IP.String()),
@@ -74,8 +241,13 @@ func (store *SqliteStore) Create(ctx context.Context, session sessionup.Session)
 		wrapNullString(session.Agent.Browser),
 		serializeMetadata(session.Meta),
 	)
-	var sqliteError sqlite3.Error
-	if errors.As(err, &sqliteError) && sqliteError.Code == sqlite3.ErrConstraint {
+	return store.checkDuplicateID(err)
+}
+
+// checkDuplicateID returns sessionup.ErrDuplicateID if err was produced by
+// inserting a session whose ID is already used, err otherwise.
+func (store *SqliteStore) checkDuplicateID(err error) error {
+	if store.dialect.IsConstraintViolation(err) {
 		return sessionup.ErrDuplicateID
 	}
 	return err
@@ -91,59 +263,209 @@ func wrapNullString(s string) sql.NullString {
 	return nullString
 }
 
+// now returns the current time of the store's clock in UTC.
+// Timestamps are always stored in UTC so that they can be compared as strings
+// in SQL, regardless of the time zone of the server.
+func (store *SqliteStore) now() time.Time {
+	return store.clock.Now().UTC()
+}
+
 // FetchByID implements sessionup.Store interface's FetchByID method.
-func (store *SqliteStore) FetchByID(ctx context.Context, id string) (sessionup.Session, bool, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE id = $1 AND expires_at > datetime('now', 'localtime');", store.tableName) // nolint:gosec // Concatenation is used for table name, not bound parameters
-	row := store.db.QueryRowContext(ctx, query, id)
+// When sliding expiration is enabled with WithSlidingExpiration, the found
+// session is extended if it is about to expire. When a cache is set with
+// WithCache, the session is read from the cache if it is there. When a
+// negative cache is set with WithNegativeCache, IDs recently not found are
+// not looked up again.
+func (store *SqliteStore) FetchByID(ctx context.Context, id string) (session sessionup.Session, found bool, err error) {
+	now := store.now()
+	if session, found = store.cache.get(id, now); found {
+		return session, true, nil
+	}
+	if _, unknown := store.unknownIDs.get(id, now); unknown {
+		return sessionup.Session{}, false, nil
+	}
+	store.cache.countMiss()
 
-	var session sessionup.Session
-	var ip, os, browser, metadata sql.NullString
+	generation := store.cache.currentGeneration()
+	unknownGeneration := store.unknownIDs.currentGeneration()
+	err = store.retryBusy(ctx, func() error {
+		session, found, err = store.fetchByID(ctx, store.readStmt, id)
+		return err
+	})
+	if err != nil {
+		return session, found, err
+	}
+
+	if found {
+		store.cache.put(session, now, store.cacheableUntil(session), generation)
+	} else {
+		store.unknownIDs.putUnknown(id, now, unknownGeneration)
+	}
+	return session, found, nil
+}
+
+// cacheableUntil returns until when session can be served from the cache:
+// its expiration time, or the time it must be extended when sliding
+// expiration is enabled.
+func (store *SqliteStore) cacheableUntil(session sessionup.Session) time.Time {
+	if store.slidingIdleTimeout > 0 {
+		return session.ExpiresAt.Add(-store.slidingThreshold)
+	}
+	return session.ExpiresAt
+}
+
+// fetchByID retrieves the session with the given ID using the statements
+// returned by stmt.
+func (store *SqliteStore) fetchByID(ctx context.Context, stmt func(statement) *sql.Stmt, id string) (sessionup.Session, bool, error) {
+	now := store.now()
+	row := stmt(fetchByIDStatement).QueryRowContext(ctx, store.expiryArgs(now, id)...)
 
-	err := row.Scan(&session.CreatedAt, &session.ExpiresAt, &session.ID, &session.UserKey, &ip, &os, &browser, &metadata)
+	session, err := scanSession(row)
 	if errors.Is(err, sql.ErrNoRows) {
 		return sessionup.Session{}, false, nil
 	} else if err != nil {
 		return sessionup.Session{}, false, err
 	}
+	store.capExpiresAt(&session)
 
-	if ip.Valid {
-		session.IP = net.ParseIP(ip.String)
+	if err = store.extendIfExpiringSoon(ctx, stmt(extendStatement), &session, now); err != nil {
+		return sessionup.Session{}, false, err
 	}
-
-	session.Agent.OS = os.String
-	session.Agent.Browser = browser.String
-	session.Meta = parseMetadata(metadata)
 	return session, true, nil
 }
 
+// extendIfExpiringSoon pushes the expiration time of session to now plus the
+// sliding idle timeout when it expires within the sliding threshold. It is
+// not extended beyond its maximum lifetime.
+// A session is never shortened, so that concurrent requests extending the
+// same session cannot undo each other.
+func (store *SqliteStore) extendIfExpiringSoon(ctx context.Context, extendStmt *sql.Stmt, session *sessionup.Session, now time.Time) error {
+	if store.slidingIdleTimeout <= 0 || session.ExpiresAt.Sub(now) >= store.slidingThreshold {
+		return nil
+	}
+
+	expiresAt := now.Add(store.slidingIdleTimeout)
+	if store.maxLifetime > 0 {
+		if lifetimeEnd := session.CreatedAt.Add(store.maxLifetime); expiresAt.After(lifetimeEnd) {
+			expiresAt = lifetimeEnd
+		}
+	}
+	if !expiresAt.After(session.ExpiresAt) {
+		return nil
+	}
+
+	result, err := extendStmt.ExecContext(ctx, store.expiryArgs(now, expiresAt, session.ID)...)
+	if err != nil {
+		return err
+	}
+	extended, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if extended > 0 {
+		session.ExpiresAt = expiresAt
+	}
+	return nil
+}
+
+// Touch sets the expiration time of the session with the given ID to
+// expiresAt, keeping the rest of the session as is. It can be used to
+// implement idle timeouts. Expired sessions cannot be touched. A session
+// touched beyond its maximum lifetime still expires at the end of it.
+// Touch returns false if no unexpired session has the given ID.
+func (store *SqliteStore) Touch(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	var result sql.Result
+	err := store.retryBusy(ctx, func() (err error) {
+		result, err = store.stmt(touchStatement).ExecContext(ctx, store.expiryArgs(store.now(), expiresAt.UTC(), id)...)
+		return err
+	})
+	store.cache.remove(id)
+	if err != nil {
+		return false, err
+	}
+	touched, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return touched > 0, nil
+}
+
+// Rotate replaces the ID of the session with the given oldID by newID, and
+// sets its expiration time to expiresAt. The rest of the session, including
+// its creation time, is kept. It is meant to issue a new session ID after a
+// change of privileges.
+// The session is copied and the old one deleted in a single transaction.
+// Rotate returns sessionup.ErrDuplicateID if newID is already used, and false
+// if no unexpired session has the given oldID.
+func (store *SqliteStore) Rotate(ctx context.Context, oldID, newID string, expiresAt time.Time) (rotated bool, err error) {
+	err = store.retryBusy(ctx, func() error {
+		rotated, err = store.rotate(ctx, oldID, newID, expiresAt)
+		return err
+	})
+	store.cache.remove(oldID, newID)
+	store.unknownIDs.remove(newID)
+	return rotated, err
+}
+
+// rotate replaces the ID of a session like Rotate, without retrying.
+func (store *SqliteStore) rotate(ctx context.Context, oldID, newID string, expiresAt time.Time) (bool, error) {
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback() // nolint:errcheck // Rollback after Commit is a no-op
+
+	args := store.expiryArgs(store.now(), expiresAt.UTC(), newID, oldID)
+	result, err := tx.StmtContext(ctx, store.stmt(rotateStatement)).ExecContext(ctx, args...)
+	if err != nil {
+		return false, store.checkDuplicateID(err)
+	}
+	copied, err := result.RowsAffected()
+	if err != nil || copied == 0 {
+		return false, err
+	}
+
+	_, err = tx.StmtContext(ctx, store.stmt(deleteByIDStatement)).ExecContext(ctx, oldID)
+	if err != nil {
+		return false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // FetchByUserKey implements sessionup.Store interface's FetchByUserKey method.
+// Expired sessions are not returned, use FetchAllByUserKey to get them too.
 func (store *SqliteStore) FetchByUserKey(ctx context.Context, key string) ([]sessionup.Session, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE user_key = $1;", store.tableName) // nolint:gosec // Concatenation is used for table name, not bound parameters
-	rows, err := store.db.QueryContext(ctx, query, key)
+	return store.fetchSessions(ctx, store.readStmt(fetchByUserKeyStatement), store.expiryArgs(store.now(), key)...)
+}
+
+// FetchAllByUserKey retrieves all sessions associated with the provided user
+// key, including the expired sessions that have not been cleaned up yet.
+// It is meant for auditing, sessionup.Manager uses FetchByUserKey.
+func (store *SqliteStore) FetchAllByUserKey(ctx context.Context, key string) ([]sessionup.Session, error) {
+	return store.fetchSessions(ctx, store.readStmt(fetchAllByUserKeyStatement), key)
+}
+
+// fetchSessions retrieves the sessions selected by the given statement. If
+// none are found, it returns nil.
+func (store *SqliteStore) fetchSessions(ctx context.Context, stmt *sql.Stmt, args ...interface{}) ([]sessionup.Session, error) {
+	rows, err := stmt.QueryContext(ctx, args...)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	var foundSessions []sessionup.Session
 	for rows.Next() {
-		var session sessionup.Session
-		var ip, os, browser, metadata sql.NullString
-
-		err := rows.Scan(&session.CreatedAt, &session.ExpiresAt, &session.ID, &session.UserKey, &ip, &os, &browser, &metadata)
+		session, err := scanSession(rows)
 		if err != nil {
-			defer rows.Close()
 			return nil, err
 		}
-
-		if ip.Valid {
-			session.IP = net.ParseIP(ip.String)
-		}
-
-		session.Agent.OS = os.String
-		session.Agent.Browser = browser.String
-		session.Meta = parseMetadata(metadata)
+		store.capExpiresAt(&session)
 
 		foundSessions = append(foundSessions, session)
 	}
@@ -155,96 +477,115 @@ func (store *SqliteStore) FetchByUserKey(ctx context.Context, key string) ([]ses
 	return foundSessions, nil
 }
 
-// serializeMetadata converts metadata map of string to a string to be saved in DB.
+// capExpiresAt brings the expiration time of session forward to the end of
+// its maximum lifetime, if it is set and comes first.
+func (store *SqliteStore) capExpiresAt(session *sessionup.Session) {
+	if store.maxLifetime <= 0 {
+		return
+	}
+	if lifetimeEnd := session.CreatedAt.Add(store.maxLifetime); session.ExpiresAt.After(lifetimeEnd) {
+		session.ExpiresAt = lifetimeEnd
+	}
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSession reads a session from the current row. The columns that follow
+// the session columns, if any, are read into extra.
+func scanSession(row rowScanner, extra ...interface{}) (sessionup.Session, error) {
+	var session sessionup.Session
+	var ip, os, browser, metadata sql.NullString
+
+	dest := append([]interface{}{&session.CreatedAt, &session.ExpiresAt, &session.ID, &session.UserKey, &ip, &os, &browser, &metadata}, extra...)
+	err := row.Scan(dest...)
+	if err != nil {
+		return sessionup.Session{}, err
+	}
+
+	// Drivers may return timestamps in the local time zone when it is UTC.
+	session.CreatedAt = session.CreatedAt.UTC()
+	session.ExpiresAt = session.ExpiresAt.UTC()
+	if ip.Valid {
+		session.IP = net.ParseIP(ip.String)
+	}
+
+	session.Agent.OS = os.String
+	session.Agent.Browser = browser.String
+	session.Meta, err = parseMetadata(metadata)
+	if err != nil {
+		return sessionup.Session{}, err
+	}
+	return session, nil
+}
+
+// serializeMetadata converts metadata map of string to a JSON object to be
+// saved in DB.
 func serializeMetadata(source map[string]string) sql.NullString {
-	var builder strings.Builder
-	for key, value := range source {
-		builder.WriteString(fmt.Sprintf("%s:%s;", key, value))
+	if len(source) == 0 {
+		return sql.NullString{}
 	}
-	return wrapNullString(builder.String())
+
+	// A map of strings can always be marshaled.
+	serialized, _ := json.Marshal(source)
+	return wrapNullString(string(serialized))
 }
 
-// parseMetadata converts metadata string from DB into a map of strings.
-func parseMetadata(source sql.NullString) map[string]string {
+// parseMetadata converts metadata JSON object from DB into a map of strings.
+func parseMetadata(source sql.NullString) (map[string]string, error) {
 	if !source.Valid {
-		return nil
+		return nil, nil
 	}
 
-	meta := make(map[string]string)
-	parts := strings.Split(source.String, PART_SEPARATOR)
-	for _, part := range parts {
-		keyValue := strings.Split(part, KEY_VALUE_SEPARATOR)
-		if len(keyValue) != 2 {
-			continue
-		}
-
-		meta[keyValue[0]] = keyValue[1]
+	var meta map[string]string
+	if err := json.Unmarshal([]byte(source.String), &meta); err != nil {
+		return nil, fmt.Errorf("sqlitestore: could not parse session metadata: %w", err)
 	}
-	return meta
+	return meta, nil
 }
 
 // DeleteByID implements sessionup.Store interface's DeleteByID method.
 func (store *SqliteStore) DeleteByID(ctx context.Context, id string) error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE id = $1;", store.tableName)
-	_, err := store.db.ExecContext(ctx, query, id)
+	err := store.retryBusy(ctx, func() error {
+		_, err := store.stmt(deleteByIDStatement).ExecContext(ctx, id)
+		return err
+	})
+	store.cache.remove(id)
 	return err
 }
 
 // DeleteByUserKey implements sessionup.Store interface's DeleteByUserKey method.
 func (store *SqliteStore) DeleteByUserKey(ctx context.Context, key string, sessionIDsToKeep ...string) error {
+	err := store.retryBusy(ctx, func() error {
+		return store.deleteByUserKey(ctx, store.stmt, store.db, key, sessionIDsToKeep)
+	})
+	store.cache.removeUserKey(key, sessionIDsToKeep...)
+	return err
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// deleteByUserKey deletes the sessions of the given user key, except those
+// whose IDs are given, using the statements returned by stmt. The query
+// excluding the IDs to keep cannot be prepared in advance, it is run by
+// exec.
+func (store *SqliteStore) deleteByUserKey(ctx context.Context, stmt func(statement) *sql.Stmt, exec execer, key string, sessionIDsToKeep []string) error {
 	if len(sessionIDsToKeep) > 0 {
 		params := make([]interface{}, 0)
 		params = append(params, key)
 		for _, id := range sessionIDsToKeep {
 			params = append(params, id)
 		}
-		query := fmt.Sprintf("DELETE FROM %s WHERE user_key = $1 AND id NOT IN (?"+strings.Repeat(",?", len(params)-2)+");", store.tableName)
-		_, err := store.db.ExecContext(ctx, query, params...)
+		query := fmt.Sprintf("DELETE FROM %s WHERE user_key = $1 AND id NOT IN (?"+strings.Repeat(",?", len(params)-2)+");", store.table)
+		_, err := exec.ExecContext(ctx, query, params...)
 		return err
 	}
 
-	query := fmt.Sprintf("DELETE FROM %s WHERE user_key = $1;", store.tableName)
-	_, err := store.db.ExecContext(ctx, query, key)
+	_, err := stmt(deleteByUserKeyStatement).ExecContext(ctx, key)
 	return err
 }
-
-// deleteExpired deletes all expired sessions.
-func (store *SqliteStore) deleteExpired() error {
-	query := fmt.Sprintf("DELETE FROM %s WHERE expires_at < datetime('now', 'localtime');", store.tableName)
-	_, err := store.db.Exec(query)
-	return err
-}
-
-func (store *SqliteStore) startCleanup(duration time.Duration) {
-	store.stopChan = make(chan struct{})
-	timer := time.NewTicker(duration)
-	for {
-		select {
-		case <-timer.C:
-			if err := store.deleteExpired(); err != nil {
-				store.errChan <- err
-			}
-
-		case <-store.stopChan:
-			timer.Stop()
-			return
-		}
-	}
-}
-
-// StopCleanup terminates the automatic cleanup process.
-// Useful for testing and cases when store is used only temporarily.
-// In order to restart the cleanup, a new store must be created.
-func (store *SqliteStore) StopCleanup() {
-	if store.stopChan != nil {
-		store.stopChan <- struct{}{}
-	}
-}
-
-// CleanupErr returns a receive-only channel to get errors produced during the
-// automatic cleanup.
-// NOTE: channel must be drained in order for the cleanup process to be able to
-// continue.
-func (store *SqliteStore) CleanupErr() <-chan error {
-	return store.errChan
-}
@@ -3,17 +3,24 @@ package sqlitestore_test
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
 	sqlitestore "github.com/hyzual/sessionup-sqlitestore"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/hyzual/sessionup-sqlitestore/sqlitestoretest"
 	"github.com/swithek/sessionup"
 )
 
 func TestSessionByIDIntegration(t *testing.T) {
-	db, err := sql.Open("sqlite3", "file:database.db?mode=memory")
+	db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
 	if err != nil {
 		db.Close()
 		t.Fatalf("could not open in-memory database: %v", err)
@@ -79,7 +86,7 @@ func TestSessionByIDIntegration(t *testing.T) {
 }
 
 func TestSessionsByUserKeyIntegration(t *testing.T) {
-	db, err := sql.Open("sqlite3", "file:database.db?mode=memory")
+	db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
 	if err != nil {
 		db.Close()
 		t.Fatalf("could not open in-memory database: %v", err)
@@ -129,14 +136,22 @@ func TestSessionsByUserKeyIntegration(t *testing.T) {
 		t.Fatalf("expected to find sessions by their key, but they were not found")
 	}
 	assertSessionsContains(t, validSession, actualSessions)
-	assertSessionsContains(t, expiredSession, actualSessions)
+	assertSessionsDoesNotContain(t, expiredSession, actualSessions)
 	assertSessionsContains(t, sessionToBeDeleted, actualSessions)
 
+	allSessions, err := store.FetchAllByUserKey(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching all the sessions by user key: %v", err)
+	}
+	assertSessionsContains(t, validSession, allSessions)
+	assertSessionsContains(t, expiredSession, allSessions)
+	assertSessionsContains(t, sessionToBeDeleted, allSessions)
+
 	err = store.DeleteByUserKey(context.Background(), "key", "valid", "expired")
 	if err != nil {
 		t.Fatalf("unexpected error while deleting sessions with exceptions: %v", err)
 	}
-	sessionsAfterDeletion, err := store.FetchByUserKey(context.Background(), "key")
+	sessionsAfterDeletion, err := store.FetchAllByUserKey(context.Background(), "key")
 	if err != nil {
 		t.Fatalf("unexpected error while fetching again the sessions by user key: %v", err)
 	}
@@ -148,7 +163,7 @@ func TestSessionsByUserKeyIntegration(t *testing.T) {
 	if err != nil {
 		t.Fatalf("unexpected error while deleting all sessions by key: %v", err)
 	}
-	sessionsAfterSecondDeletion, err := store.FetchByUserKey(context.Background(), "key")
+	sessionsAfterSecondDeletion, err := store.FetchAllByUserKey(context.Background(), "key")
 	if err != nil {
 		t.Fatalf("unexpected error while fetching for the third time sessions by user key: %v", err)
 	}
@@ -158,35 +173,48 @@ func TestSessionsByUserKeyIntegration(t *testing.T) {
 }
 
 func TestExpiredSessionsCleanupIntegration(t *testing.T) {
-	db, err := sql.Open("sqlite3", "file:database.db?mode=memory")
+	db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
 	if err != nil {
 		db.Close()
 		t.Fatalf("could not open in-memory database: %v", err)
 	}
 	defer db.Close()
+	// Every connection to an in-memory database gets its own database, the
+	// cleanup must see the same one.
+	db.SetMaxOpenConns(1)
 
-	store, err := sqlitestore.New(db, "sessions", time.Millisecond*20)
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(time.Minute),
+		sqlitestore.WithClock(clock),
+	)
 	if err != nil {
 		t.Fatalf("could not create a new sessions table: %v", err)
 	}
 
-	firstExpiredSession := sessionup.Session{
-		CreatedAt: time.Now().Add(time.Hour * -2),
-		ExpiresAt: time.Now().Add(time.Hour * -1),
-		ID:        "first",
+	validSession := sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Minute * 30),
+		ID:        "valid",
 		UserKey:   "key",
 		IP:        net.ParseIP("127.0.0.1"),
 	}
-	secondExpiredSession := sessionup.Session{
-		CreatedAt: time.Now().Add(time.Hour * -3),
-		ExpiresAt: time.Now().Add(time.Hour * -2),
-		ID:        "second",
+	soonExpiredSession := sessionup.Session{
+		CreatedAt: clock.Now().Add(time.Hour * -1),
+		ExpiresAt: clock.Now().Add(time.Second * 30),
+		ID:        "soon_expired",
 		UserKey:   "key",
 		IP:        net.ParseIP("127.0.0.1"),
 	}
-	sessions := []sessionup.Session{firstExpiredSession, secondExpiredSession}
-
-	createSessions := func() {
+	expiredSession := sessionup.Session{
+		CreatedAt: clock.Now().Add(time.Hour * -2),
+		ExpiresAt: clock.Now().Add(time.Hour * -1),
+		ID:        "expired",
+		UserKey:   "key",
+		IP:        net.ParseIP("127.0.0.1"),
+	}
+	createSessions := func(sessions ...sessionup.Session) {
 		for _, s := range sessions {
 			err = store.Create(context.Background(), s)
 			if err != nil {
@@ -195,33 +223,1359 @@ func TestExpiredSessionsCleanupIntegration(t *testing.T) {
 		}
 	}
 
-	waitForCleanup := func() {
-		// wait for cleanup after 20 ms
-		time.Sleep(time.Millisecond * 21)
+	createSessions(validSession, soonExpiredSession, expiredSession)
+	_, ok, err := store.FetchByID(context.Background(), "soon_expired")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to find a session that is not expired yet, but it was not found")
 	}
 
-	createSessions()
-	waitForCleanup()
+	clock.Advance(time.Minute)
+	// Stopping the cleanup waits for the cleanup triggered by the tick.
+	store.StopCleanup()
 	assertErrorChannelIsEmpty(t, store.CleanupErr())
 
-	retrievedSessions, err := store.FetchByUserKey(context.Background(), "key")
+	retrievedSessions, err := store.FetchAllByUserKey(context.Background(), "key")
 	if err != nil {
-		t.Fatalf("unexpected error while fetching the sessions by user key: %v", err)
+		t.Fatalf("unexpected error while fetching all the sessions by user key: %v", err)
+	}
+	assertSessionsContains(t, validSession, retrievedSessions)
+	assertSessionsDoesNotContain(t, soonExpiredSession, retrievedSessions)
+	assertSessionsDoesNotContain(t, expiredSession, retrievedSessions)
+
+	createSessions(expiredSession)
+	clock.Advance(time.Minute)
+
+	retrievedSessions, err = store.FetchAllByUserKey(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching all the sessions by user key: %v", err)
+	}
+	assertSessionsContains(t, expiredSession, retrievedSessions)
+}
+
+func TestSlidingExpirationIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:sliding.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(0),
+		sqlitestore.WithClock(clock),
+		sqlitestore.WithSlidingExpiration(time.Minute*30, time.Minute*10),
+	)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	session := sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Minute * 30),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	err = store.Create(context.Background(), session)
+	if err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	// The session is used regularly, it is extended each time it is about
+	// to expire.
+	for i := 0; i < 4; i++ {
+		clock.Advance(time.Minute * 25)
+		retrievedSession, ok, err := store.FetchByID(context.Background(), session.ID)
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+		}
+		if !ok {
+			t.Fatalf("expected the session to be extended, but it expired")
+		}
+		if expected := clock.Now().Add(time.Minute * 30); !retrievedSession.ExpiresAt.Equal(expected) {
+			t.Errorf("want the session to expire at %s, got %s", expected, retrievedSession.ExpiresAt)
+		}
+		if !retrievedSession.CreatedAt.Equal(session.CreatedAt) {
+			t.Errorf("want CreatedAt %s to be kept, got %s", session.CreatedAt, retrievedSession.CreatedAt)
+		}
+	}
+
+	// The session is idle for longer than the idle timeout.
+	clock.Advance(time.Minute * 31)
+	_, ok, err := store.FetchByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if ok {
+		t.Fatal("expected the idle session to expire, but it was found")
+	}
+
+	touched, err := store.Touch(context.Background(), session.ID, clock.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error while touching the expired session: %v", err)
+	}
+	if touched {
+		t.Error("expected the expired session not to be touched, but it was")
+	}
+}
+
+func TestTouchIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:touch.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		ID:        "id",
+		UserKey:   "key",
+		IP:        net.ParseIP("127.0.0.1"),
+		Meta:      map[string]string{"test": "1"},
+	}
+	err = store.Create(context.Background(), session)
+	if err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	session.ExpiresAt = time.Now().Add(time.Hour * 24)
+	touched, err := store.Touch(context.Background(), session.ID, session.ExpiresAt)
+	if err != nil {
+		t.Fatalf("unexpected error while touching the session: %v", err)
+	}
+	if !touched {
+		t.Fatal("expected the session to be touched, but it was not")
+	}
+
+	retrievedSession, ok, err := store.FetchByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to find session by its ID, but it was not found")
+	}
+	assertSessionEquals(t, retrievedSession, session)
+
+	touched, err = store.Touch(context.Background(), "unknown", session.ExpiresAt)
+	if err != nil {
+		t.Fatalf("unexpected error while touching an unknown session: %v", err)
+	}
+	if touched {
+		t.Error("expected an unknown session not to be touched, but it was")
+	}
+}
+
+func TestMaxLifetimeIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:lifetime.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(time.Minute),
+		sqlitestore.WithClock(clock),
+		sqlitestore.WithMaxLifetime(time.Hour*24),
+	)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
 	}
-	if len(retrievedSessions) > 0 {
-		t.Fatal("expected sessions to be empty after cleanup")
+
+	youngSession := sessionup.Session{
+		CreatedAt: clock.Now().Add(time.Hour * -1),
+		ExpiresAt: clock.Now().Add(time.Hour * 24 * 7),
+		ID:        "young",
+		UserKey:   "key",
+	}
+	oldSession := sessionup.Session{
+		CreatedAt: clock.Now().Add(time.Hour * -25),
+		ExpiresAt: clock.Now().Add(time.Hour * 24 * 7),
+		ID:        "old",
+		UserKey:   "key",
+	}
+	for _, s := range []sessionup.Session{youngSession, oldSession} {
+		err = store.Create(context.Background(), s)
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+	}
+
+	retrievedSession, ok, err := store.FetchByID(context.Background(), youngSession.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to find the session younger than the maximum lifetime, but it was not found")
+	}
+	if expected := youngSession.CreatedAt.Add(time.Hour * 24); !retrievedSession.ExpiresAt.Equal(expected) {
+		t.Errorf("want the session to expire at %s, got %s", expected, retrievedSession.ExpiresAt)
 	}
 
-	createSessions()
+	_, ok, err = store.FetchByID(context.Background(), oldSession.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if ok {
+		t.Fatal("expected not to find the session older than the maximum lifetime, but it was found")
+	}
+
+	sessions, err := store.FetchByUserKey(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching sessions by user key: %v", err)
+	}
+	assertSessionsDoesNotContain(t, oldSession, sessions)
+
+	clock.Advance(time.Minute)
 	store.StopCleanup()
-	waitForCleanup()
 
-	retrievedSessions, err = store.FetchByUserKey(context.Background(), "key")
+	sessions, err = store.FetchAllByUserKey(context.Background(), "key")
 	if err != nil {
-		t.Fatalf("unexpected error while fetching the sessions by user key: %v", err)
+		t.Fatalf("unexpected error while fetching all sessions by user key: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != youngSession.ID {
+		t.Errorf("expected the cleanup to remove only the session older than the maximum lifetime, got %v", sessions)
+	}
+}
+
+func TestRecordActivityIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:activity.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
 	}
-	if len(retrievedSessions) == 0 {
-		t.Fatal("expected to find expired sessions after stopping cleanup, but none were found")
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(0),
+		sqlitestore.WithClock(clock),
+		sqlitestore.WithActivityThreshold(time.Minute*5),
+	)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	seenSession := sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Hour),
+		ID:        "seen",
+		UserKey:   "key",
+	}
+	unseenSession := sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Hour),
+		ID:        "unseen",
+		UserKey:   "key",
+	}
+	for _, s := range []sessionup.Session{seenSession, unseenSession} {
+		err = store.Create(context.Background(), s)
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+	}
+
+	recordActivity := func(ip string) {
+		t.Helper()
+		err := store.RecordActivity(context.Background(), seenSession.ID, net.ParseIP(ip), clock.Now())
+		if err != nil {
+			t.Fatalf("unexpected error while recording activity: %v", err)
+		}
+	}
+	assertLastSeen := func(expectedAt time.Time, expectedIP string) {
+		t.Helper()
+		activities, err := store.FetchActivityByUserKey(context.Background(), "key")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching activity by user key: %v", err)
+		}
+		if len(activities) != 2 {
+			t.Fatalf("want 2 sessions, got %d", len(activities))
+		}
+		for _, activity := range activities {
+			switch activity.ID {
+			case seenSession.ID:
+				if !activity.LastSeenAt.Equal(expectedAt) || !activity.LastSeenIP.Equal(net.ParseIP(expectedIP)) {
+					t.Errorf("want last seen at %s from %s, got %s from %s", expectedAt, expectedIP, activity.LastSeenAt, activity.LastSeenIP)
+				}
+			case unseenSession.ID:
+				if !activity.LastSeenAt.IsZero() || activity.LastSeenIP != nil {
+					t.Errorf("want no activity recorded, got %s from %s", activity.LastSeenAt, activity.LastSeenIP)
+				}
+			}
+		}
+	}
+
+	firstSeenAt := clock.Now()
+	recordActivity("127.0.0.1")
+	assertLastSeen(firstSeenAt, "127.0.0.1")
+
+	// Activity within the threshold is coalesced.
+	clock.Advance(time.Minute)
+	recordActivity("127.0.0.2")
+	assertLastSeen(firstSeenAt, "127.0.0.1")
+
+	clock.Advance(time.Minute * 5)
+	recordActivity("127.0.0.2")
+	assertLastSeen(clock.Now(), "127.0.0.2")
+}
+
+func TestExpiredSessionsBatchCleanupIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
+	if err != nil {
+		db.Close()
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	deletedCounts := make(chan int64, 1)
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(time.Minute),
+		sqlitestore.WithCleanupBatchSize(10),
+		sqlitestore.WithCleanupBatchPause(0),
+		sqlitestore.WithCleanupResultHandler(func(deleted int64) { deletedCounts <- deleted }),
+		sqlitestore.WithClock(clock),
+	)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	for i := 0; i < 25; i++ {
+		err = store.Create(context.Background(), sessionup.Session{
+			CreatedAt: clock.Now().Add(time.Hour * -2),
+			ExpiresAt: clock.Now().Add(time.Hour * -1),
+			ID:        fmt.Sprintf("expired%d", i),
+			UserKey:   "key",
+		})
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+	}
+	validSession := sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Hour * 1),
+		ID:        "valid",
+		UserKey:   "key",
+	}
+	err = store.Create(context.Background(), validSession)
+	if err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	clock.Advance(time.Minute)
+	if deleted := <-deletedCounts; deleted != 25 {
+		t.Errorf("want 25 deleted sessions, got %d", deleted)
+	}
+
+	retrievedSessions, err := store.FetchAllByUserKey(context.Background(), "key")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching all the sessions by user key: %v", err)
+	}
+	if len(retrievedSessions) != 1 {
+		t.Fatalf("want only the valid session to remain, got %v", retrievedSessions)
+	}
+	assertSessionEquals(t, retrievedSessions[0], validSession)
+}
+
+func TestPreparedStatementsOnNewConnectionsIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open(driverName, withDriverParams(filepath.Join(dir, "sessions.db")))
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer db.Close()
+	// Connections are closed after every use, so every call prepares its
+	// statement again on a new connection.
+	db.SetMaxIdleConns(0)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 1),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	for i := 0; i < 3; i++ {
+		err = store.Create(context.Background(), session)
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+		retrievedSession, ok, err := store.FetchByID(context.Background(), session.ID)
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+		}
+		if !ok {
+			t.Fatalf("expected to find session by its ID, but it was not found")
+		}
+		assertSessionEquals(t, retrievedSession, session)
+		err = store.DeleteByID(context.Background(), session.ID)
+		if err != nil {
+			t.Fatalf("unexpected error while deleting the session by its ID: %v", err)
+		}
+	}
+}
+
+func TestTableNamesIntegration(t *testing.T) {
+	for _, tableName := range []string{"order", "my-sessions", "aux.sessions"} {
+		t.Run(tableName, func(t *testing.T) {
+			db, err := sql.Open(driverName, withDriverParams("file:tablenames.db?mode=memory"))
+			if err != nil {
+				t.Fatalf("could not open in-memory database: %v", err)
+			}
+			defer db.Close()
+			// The attached database only exists on the connection that
+			// attached it.
+			db.SetMaxOpenConns(1)
+			_, err = db.Exec("ATTACH DATABASE 'file:aux.db?mode=memory' AS aux;")
+			if err != nil {
+				t.Fatalf("could not attach a database: %v", err)
+			}
+
+			store, err := sqlitestore.New(db, tableName, 0)
+			if err != nil {
+				t.Fatalf("could not create a new sessions table: %v", err)
+			}
+			defer store.Close(context.Background())
+
+			session := sessionup.Session{
+				CreatedAt: time.Now(),
+				ExpiresAt: time.Now().Add(time.Hour * 1),
+				ID:        "id",
+				UserKey:   "key",
+			}
+			err = store.Create(context.Background(), session)
+			if err != nil {
+				t.Fatalf("could not create a session: %v", err)
+			}
+			sessions, err := store.FetchByUserKey(context.Background(), session.UserKey)
+			if err != nil {
+				t.Fatalf("unexpected error while fetching sessions by user key: %v", err)
+			}
+			assertSessionsContains(t, session, sessions)
+		})
+	}
+
+	t.Run("invalid table name", func(t *testing.T) {
+		db, err := sql.Open(driverName, withDriverParams("file:tablenames.db?mode=memory"))
+		if err != nil {
+			t.Fatalf("could not open in-memory database: %v", err)
+		}
+		defer db.Close()
+
+		_, err = sqlitestore.New(db, "main.aux.sessions", 0)
+		var invalidNameError *sqlitestore.InvalidTableNameError
+		if !errors.As(err, &invalidNameError) {
+			t.Errorf("want an *InvalidTableNameError, got %v", err)
+		}
+	})
+}
+
+func TestSessionLimitIntegration(t *testing.T) {
+	openStore := func(t *testing.T, policy sqlitestore.LimitPolicy) (*sql.DB, *sqlitestore.SqliteStore) {
+		t.Helper()
+		dir, err := ioutil.TempDir("", "sqlitestore")
+		if err != nil {
+			t.Fatalf("could not create a temporary directory: %v", err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+
+		db, err := sql.Open(driverName, withDriverParams(filepath.Join(dir, "sessions.db")))
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		store, err := sqlitestore.NewWithOptions(
+			db,
+			sqlitestore.WithCleanupInterval(0),
+			sqlitestore.WithSessionLimit(3, policy),
+		)
+		if err != nil {
+			t.Fatalf("could not create a new sessions table: %v", err)
+		}
+		t.Cleanup(func() { store.Close(context.Background()) })
+		return db, store
+	}
+	newSession := func(id string, createdAt time.Time) sessionup.Session {
+		return sessionup.Session{
+			CreatedAt: createdAt,
+			ExpiresAt: createdAt.Add(time.Hour * 24),
+			ID:        id,
+			UserKey:   "key",
+		}
+	}
+
+	t.Run("holds under concurrent logins", func(t *testing.T) {
+		_, store := openStore(t, sqlitestore.RejectNewSessions)
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs <- store.Create(context.Background(), newSession(fmt.Sprintf("id%d", i), time.Now()))
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+
+		var created, rejected int
+		for err := range errs {
+			var limitError *sqlitestore.SessionLimitError
+			switch {
+			case err == nil:
+				created++
+			case errors.As(err, &limitError):
+				rejected++
+			default:
+				t.Errorf("unexpected error while creating a session: %v", err)
+			}
+		}
+		if created != 3 || rejected != 7 {
+			t.Errorf("want 3 sessions created and 7 rejected, got %d created and %d rejected", created, rejected)
+		}
+
+		sessions, err := store.FetchByUserKey(context.Background(), "key")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching sessions by user key: %v", err)
+		}
+		if len(sessions) != 3 {
+			t.Errorf("want 3 sessions, got %d", len(sessions))
+		}
+	})
+
+	t.Run("evicts the oldest sessions", func(t *testing.T) {
+		_, store := openStore(t, sqlitestore.EvictOldestSessions)
+
+		start := time.Now().Add(time.Hour * -1)
+		var all []sessionup.Session
+		for i := 0; i < 5; i++ {
+			session := newSession(fmt.Sprintf("id%d", i), start.Add(time.Minute*time.Duration(i)))
+			err := store.Create(context.Background(), session)
+			if err != nil {
+				t.Fatalf("could not create a session: %v", err)
+			}
+			all = append(all, session)
+		}
+
+		sessions, err := store.FetchByUserKey(context.Background(), "key")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching sessions by user key: %v", err)
+		}
+		if len(sessions) != 3 {
+			t.Errorf("want 3 sessions, got %d", len(sessions))
+		}
+		for _, evicted := range all[:2] {
+			assertSessionsDoesNotContain(t, evicted, sessions)
+		}
+		for _, kept := range all[2:] {
+			assertSessionsContains(t, kept, sessions)
+		}
+	})
+}
+
+func TestOpenIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := []sqlitestore.Option{sqlitestore.WithCleanupInterval(0)}
+	if driverName == "sqlite" {
+		opts = append(opts, sqlitestore.WithDialect(sqlitestore.ModerncDialect{}))
+	}
+	store, err := sqlitestore.Open(filepath.Join(dir, "sessions.db"), opts...)
+	if err != nil {
+		t.Fatalf("could not open the store: %v", err)
+	}
+	db := store.DB()
+
+	t.Run("sets up every connection", func(t *testing.T) {
+		pragmas := map[string]string{
+			"journal_mode": "wal",
+			"busy_timeout": "5000",
+			"foreign_keys": "1",
+			"synchronous":  "1",
+		}
+		for pragma, expected := range pragmas {
+			var actual string
+			if err := db.QueryRow("PRAGMA " + pragma).Scan(&actual); err != nil {
+				t.Fatalf("could not read pragma %s: %v", pragma, err)
+			}
+			if actual != expected {
+				t.Errorf("want pragma %s to be %q, got %q", pragma, expected, actual)
+			}
+		}
+	})
+
+	t.Run("stores sessions", func(t *testing.T) {
+		session := sessionup.Session{
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour * 24),
+			ID:        "id",
+			UserKey:   "key",
+		}
+		if err := store.Create(context.Background(), session); err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+		_, found, err := store.FetchByID(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching session by ID: %v", err)
+		}
+		if !found {
+			t.Error("want the session to be found")
+		}
+	})
+
+	t.Run("closes the database with the store", func(t *testing.T) {
+		if err := store.Close(context.Background()); err != nil {
+			t.Fatalf("could not close the store: %v", err)
+		}
+		if err := db.Ping(); err == nil {
+			t.Error("expected an error when using a closed database, but did not get one")
+		}
+	})
+}
+
+func TestOpenInMemoryIntegration(t *testing.T) {
+	opts := []sqlitestore.Option{sqlitestore.WithCleanupInterval(0)}
+	if driverName == "sqlite" {
+		opts = append(opts, sqlitestore.WithDialect(sqlitestore.ModerncDialect{}))
+	}
+	store, err := sqlitestore.Open("file::memory:", opts...)
+	if err != nil {
+		t.Fatalf("could not open the store: %v", err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+
+	if conns := store.DB().Stats().MaxOpenConnections; conns != 1 {
+		t.Errorf("want a single connection to the in-memory database, got %d", conns)
+	}
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 24),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	if err = store.Create(context.Background(), session); err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+}
+
+func TestReadAndWritePoolsIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sessions.db")
+
+	writeDB, err := sql.Open(driverName, withDriverParams(path))
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() { writeDB.Close() })
+	writeDB.SetMaxOpenConns(1)
+	if _, err = writeDB.Exec("PRAGMA journal_mode = WAL;"); err != nil {
+		t.Fatalf("could not enable write-ahead logging: %v", err)
+	}
+
+	readDB, err := sql.Open(driverName, withDriverParams("file:"+path+"?"+readOnly))
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	t.Cleanup(func() { readDB.Close() })
+
+	store, err := sqlitestore.NewWithPools(readDB, writeDB, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 24),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	if err = store.Create(context.Background(), session); err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	t.Run("reads what was written", func(t *testing.T) {
+		actual, found, err := store.FetchByID(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching session by ID: %v", err)
+		}
+		if !found {
+			t.Fatal("want the session to be found")
+		}
+		assertSessionEquals(t, actual, session)
+	})
+
+	t.Run("reads while a write is in progress", func(t *testing.T) {
+		tx, err := writeDB.Begin()
+		if err != nil {
+			t.Fatalf("could not begin a transaction: %v", err)
+		}
+		defer tx.Rollback()
+		if _, err = tx.Exec(`DELETE FROM "sessions" WHERE id = 'id';`); err != nil {
+			t.Fatalf("could not delete the session: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		sessions, err := store.FetchByUserKey(ctx, "key")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching sessions by user key: %v", err)
+		}
+		assertSessionsContains(t, session, sessions)
+	})
+
+	t.Run("the read pool cannot write", func(t *testing.T) {
+		if _, err := readDB.Exec(`DELETE FROM "sessions";`); err == nil {
+			t.Error("expected an error when writing with the read pool, but did not get one")
+		}
+	})
+}
+
+func TestCacheIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:cache.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0), sqlitestore.WithCache(10, time.Minute))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 24),
+		ID:        "id",
+		UserKey:   "key",
+		Meta:      map[string]string{"test": "1"},
+	}
+	if err = store.Create(context.Background(), session); err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	fetch := func(t *testing.T, id string) (sessionup.Session, bool) {
+		t.Helper()
+		actual, found, err := store.FetchByID(context.Background(), id)
+		if err != nil {
+			t.Fatalf("unexpected error while fetching session by ID: %v", err)
+		}
+		return actual, found
+	}
+
+	t.Run("serves hot sessions from memory", func(t *testing.T) {
+		fetch(t, "id")
+		actual, found := fetch(t, "id")
+		if !found {
+			t.Fatal("want the session to be found")
+		}
+		assertSessionEquals(t, actual, session)
+		if stats := store.CacheStats(); stats.Hits != 1 || stats.Misses != 1 {
+			t.Errorf("want 1 hit and 1 miss, got %+v", stats)
+		}
+	})
+
+	t.Run("sees the changes made through the store", func(t *testing.T) {
+		if _, err := store.UpdateMeta(context.Background(), "id", map[string]string{"test": "2"}, nil); err != nil {
+			t.Fatalf("could not update the metadata: %v", err)
+		}
+		actual, _ := fetch(t, "id")
+		if actual.Meta["test"] != "2" {
+			t.Errorf("want the updated metadata, got %v", actual.Meta)
+		}
+
+		if _, err := store.Rotate(context.Background(), "id", "rotated", session.ExpiresAt); err != nil {
+			t.Fatalf("could not rotate the session: %v", err)
+		}
+		if _, found := fetch(t, "id"); found {
+			t.Error("want the rotated session not to be found by its former ID")
+		}
+
+		fetch(t, "rotated")
+		if err := store.DeleteByUserKey(context.Background(), "key"); err != nil {
+			t.Fatalf("could not delete the sessions: %v", err)
+		}
+		if _, found := fetch(t, "rotated"); found {
+			t.Error("want the deleted session not to be found")
+		}
+	})
+}
+
+func TestNegativeCacheIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:negative.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0), sqlitestore.WithNegativeCache(10, time.Second*10))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	t.Cleanup(func() { store.Close(context.Background()) })
+
+	fetch := func(t *testing.T) bool {
+		t.Helper()
+		_, found, err := store.FetchByID(context.Background(), "id")
+		if err != nil {
+			t.Fatalf("unexpected error while fetching session by ID: %v", err)
+		}
+		return found
+	}
+
+	for i := 0; i < 3; i++ {
+		if fetch(t) {
+			t.Fatal("want the unknown session not to be found")
+		}
+	}
+	if stats := store.CacheStats(); stats.NegativeHits != 2 {
+		t.Errorf("want 2 negative hits, got %+v", stats)
+	}
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 24),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	if err = store.Create(context.Background(), session); err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+	if !fetch(t) {
+		t.Error("want the created session to be found")
+	}
+}
+
+func TestBusyRetryIntegration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if err != nil {
+		t.Fatalf("could not create a temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	dsn := withDriverParams(filepath.Join(dir, "sessions.db") + "?" + noBusyTimeout)
+
+	openStore := func(t *testing.T, opts ...sqlitestore.Option) *sqlitestore.SqliteStore {
+		t.Helper()
+		db, err := sql.Open(driverName, dsn)
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		store, err := sqlitestore.NewWithOptions(db, append([]sqlitestore.Option{sqlitestore.WithCleanupInterval(0)}, opts...)...)
+		if err != nil {
+			t.Fatalf("could not create a new sessions table: %v", err)
+		}
+		t.Cleanup(func() { store.Close(context.Background()) })
+		return store
+	}
+
+	// lock takes the write lock of the database from another connection and
+	// releases it after the given delay.
+	lock := func(t *testing.T, release time.Duration) {
+		t.Helper()
+		locker, err := sql.Open(driverName, dsn)
+		if err != nil {
+			t.Fatalf("could not open database: %v", err)
+		}
+		t.Cleanup(func() { locker.Close() })
+		tx, err := locker.Begin()
+		if err != nil {
+			t.Fatalf("could not begin a transaction: %v", err)
+		}
+		if _, err = tx.Exec(`DELETE FROM "sessions" WHERE id = 'none';`); err != nil {
+			t.Fatalf("could not lock the database: %v", err)
+		}
+		released := make(chan struct{})
+		time.AfterFunc(release, func() {
+			tx.Rollback()
+			close(released)
+		})
+		t.Cleanup(func() { <-released })
+	}
+
+	newSession := func(id string) sessionup.Session {
+		return sessionup.Session{
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour * 24),
+			ID:        id,
+			UserKey:   "key",
+		}
+	}
+
+	t.Run("waits for the database to be unlocked", func(t *testing.T) {
+		store := openStore(t, sqlitestore.WithBusyRetry(100, time.Millisecond, time.Millisecond*10))
+		lock(t, time.Millisecond*50)
+
+		if err := store.Create(context.Background(), newSession("retried")); err != nil {
+			t.Fatalf("could not create a session while the database was locked: %v", err)
+		}
+		if err := store.DeleteByUserKey(context.Background(), "key"); err != nil {
+			t.Errorf("unexpected error while deleting sessions by user key: %v", err)
+		}
+	})
+
+	t.Run("without retries, the database is busy", func(t *testing.T) {
+		store := openStore(t, sqlitestore.WithBusyRetry(0, 0, 0))
+		lock(t, time.Millisecond*100)
+
+		err := store.Create(context.Background(), newSession("rejected"))
+		if err == nil {
+			t.Error("expected an error while the database was locked, but did not get one")
+		}
+	})
+}
+
+func TestRotateIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:rotate.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	session := sessionup.Session{
+		CreatedAt: time.Now().Add(time.Hour * -1),
+		ExpiresAt: time.Now().Add(time.Hour),
+		ID:        "old",
+		UserKey:   "key",
+		IP:        net.ParseIP("127.0.0.1"),
+		Meta:      map[string]string{"test": "1"},
+	}
+	session.Agent.OS = "GNU/Linux"
+	session.Agent.Browser = "Firefox"
+	other := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		ID:        "other",
+		UserKey:   "key",
+	}
+	for _, s := range []sessionup.Session{session, other} {
+		err = store.Create(context.Background(), s)
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+	}
+
+	_, err = store.Rotate(context.Background(), session.ID, other.ID, time.Now().Add(time.Hour*2))
+	if !errors.Is(err, sessionup.ErrDuplicateID) {
+		t.Errorf("want %v, got %v", sessionup.ErrDuplicateID, err)
+	}
+
+	rotatedSession := session
+	rotatedSession.ID = "new"
+	rotatedSession.ExpiresAt = time.Now().Add(time.Hour * 2)
+	rotated, err := store.Rotate(context.Background(), session.ID, rotatedSession.ID, rotatedSession.ExpiresAt)
+	if err != nil {
+		t.Fatalf("unexpected error while rotating the session: %v", err)
+	}
+	if !rotated {
+		t.Fatal("expected the session to be rotated, but it was not")
+	}
+
+	retrievedSession, ok, err := store.FetchByID(context.Background(), rotatedSession.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its new ID: %v", err)
+	}
+	if !ok {
+		t.Fatal("expected to find the session by its new ID, but it was not found")
+	}
+	assertSessionEquals(t, retrievedSession, rotatedSession)
+
+	_, ok, err = store.FetchByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its old ID: %v", err)
+	}
+	if ok {
+		t.Fatal("expected not to find the session by its old ID, but it was found")
+	}
+
+	rotated, err = store.Rotate(context.Background(), session.ID, "newer", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error while rotating a missing session: %v", err)
+	}
+	if rotated {
+		t.Error("expected a missing session not to be rotated, but it was")
+	}
+}
+
+func TestWithTxIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:tx.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+	_, err = db.Exec("CREATE TABLE audit (event TEXT NOT NULL);")
+	if err != nil {
+		t.Fatalf("could not create the audit table: %v", err)
+	}
+
+	login := func(id string) *sqlitestore.TxStore {
+		t.Helper()
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatalf("could not begin a transaction: %v", err)
+		}
+		if _, err = tx.Exec("INSERT INTO audit (event) VALUES ($1);", "login "+id); err != nil {
+			t.Fatalf("could not insert an audit row: %v", err)
+		}
+		txStore := store.WithTx(tx)
+		err = txStore.Create(context.Background(), sessionup.Session{
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(time.Hour),
+			ID:        id,
+			UserKey:   "key",
+		})
+		if err != nil {
+			t.Fatalf("could not create a session in the transaction: %v", err)
+		}
+		return txStore
+	}
+	assertFound := func(id string, expected bool) {
+		t.Helper()
+		_, ok, err := store.FetchByID(context.Background(), id)
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+		}
+		if ok != expected {
+			t.Errorf("want session %q found = %t, got %t", id, expected, ok)
+		}
+	}
+
+	if err = login("committed").Commit(); err != nil {
+		t.Fatalf("could not commit the transaction: %v", err)
+	}
+	assertFound("committed", true)
+
+	txStore := login("rolled_back")
+	_, ok, err := txStore.FetchByID(context.Background(), "rolled_back")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session in the transaction: %v", err)
+	}
+	if !ok {
+		t.Error("expected to find the session in the transaction, but it was not found")
+	}
+	if err = txStore.Rollback(); err != nil {
+		t.Fatalf("could not roll back the transaction: %v", err)
+	}
+	assertFound("rolled_back", false)
+
+	var events int
+	if err = db.QueryRow("SELECT COUNT(*) FROM audit;").Scan(&events); err != nil {
+		t.Fatalf("could not count the audit rows: %v", err)
+	}
+	if events != 1 {
+		t.Errorf("want 1 audit row, got %d", events)
+	}
+}
+
+func TestWithTxAndCacheIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:tx_cache.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	clock := sqlitestoretest.NewFakeClock(time.Now())
+	store, err := sqlitestore.NewWithOptions(
+		db,
+		sqlitestore.WithCleanupInterval(0),
+		sqlitestore.WithClock(clock),
+		sqlitestore.WithCache(10, time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	// The transaction is committed directly, not through the TxStore.
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("could not begin a transaction: %v", err)
+	}
+	if err = store.WithTx(tx).DeleteByUserKey(context.Background(), "key"); err != nil {
+		t.Fatalf("could not delete the sessions in the transaction: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatalf("could not commit the transaction: %v", err)
+	}
+
+	err = store.Create(context.Background(), sessionup.Session{
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Hour * 24),
+		ID:        "id",
+		UserKey:   "key",
+	})
+	if err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+	fetchTwice := func() {
+		t.Helper()
+		for i := 0; i < 2; i++ {
+			if _, ok, err := store.FetchByID(context.Background(), "id"); err != nil || !ok {
+				t.Fatalf("want the session to be found, got %t, %v", ok, err)
+			}
+		}
+	}
+
+	fetchTwice()
+	if stats := store.CacheStats(); stats.Hits != 0 {
+		t.Errorf("want the session not to be cached before the TTL ends, got %+v", stats)
+	}
+	clock.Advance(time.Minute)
+	fetchTwice()
+	if stats := store.CacheStats(); stats.Hits != 1 {
+		t.Errorf("want the session to be cached once the TTL ended, got %+v", stats)
+	}
+}
+
+func TestSessionMetadataIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
+	if err != nil {
+		db.Close()
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := sqlitestore.New(db, "sessions", 0)
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+
+	session := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour * 1),
+		ID:        "with_metadata",
+		UserKey:   "key",
+		Meta: map[string]string{
+			"redirect":  "https://example.com:8080/path?a=1;b=2",
+			"key:colon": "value;semicolon",
+			"login_at":  "2021-11-08T10:00:00+01:00",
+			"json":      `{"nested":["a","b"]}`,
+		},
+	}
+	err = store.Create(context.Background(), session)
+	if err != nil {
+		t.Fatalf("could not create a session: %v", err)
+	}
+
+	retrievedSession, ok, err := store.FetchByID(context.Background(), session.ID)
+	if err != nil {
+		t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected to find session by its ID, but it was not found")
+	}
+	if !reflect.DeepEqual(session.Meta, retrievedSession.Meta) {
+		t.Errorf("got Meta %v, want %v", retrievedSession.Meta, session.Meta)
+	}
+}
+
+func TestUpdateMetaIntegration(t *testing.T) {
+	db, err := sql.Open(driverName, withDriverParams("file:meta.db?mode=memory"))
+	if err != nil {
+		t.Fatalf("could not open in-memory database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	store, err := sqlitestore.NewWithOptions(db, sqlitestore.WithCleanupInterval(0))
+	if err != nil {
+		t.Fatalf("could not create a new sessions table: %v", err)
+	}
+	defer store.Close(context.Background())
+
+	tagged := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		ID:        "tagged",
+		UserKey:   "key",
+		Meta:      map[string]string{"remember_me": "true", "redirect": "/home"},
+	}
+	untagged := sessionup.Session{
+		CreatedAt: time.Now(),
+		ExpiresAt: time.Now().Add(time.Hour),
+		ID:        "untagged",
+		UserKey:   "key",
+	}
+	for _, s := range []sessionup.Session{tagged, untagged} {
+		err = store.Create(context.Background(), s)
+		if err != nil {
+			t.Fatalf("could not create a session: %v", err)
+		}
+	}
+
+	assertMeta := func(id string, expected map[string]string) {
+		t.Helper()
+		retrievedSession, _, err := store.FetchByID(context.Background(), id)
+		if err != nil {
+			t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+		}
+		if !reflect.DeepEqual(expected, retrievedSession.Meta) {
+			t.Errorf("got Meta %v, want %v", retrievedSession.Meta, expected)
+		}
+	}
+
+	updated, err := store.UpdateMeta(context.Background(), tagged.ID, map[string]string{"mfa_verified": "true", "redirect": "/admin"}, []string{"remember_me"})
+	if err != nil {
+		t.Fatalf("unexpected error while updating the metadata: %v", err)
+	}
+	if !updated {
+		t.Fatal("expected the metadata to be updated, but it was not")
+	}
+	assertMeta(tagged.ID, map[string]string{"mfa_verified": "true", "redirect": "/admin"})
+
+	_, err = store.UpdateMeta(context.Background(), untagged.ID, map[string]string{"mfa_verified": "false"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while updating the metadata: %v", err)
+	}
+	assertMeta(untagged.ID, map[string]string{"mfa_verified": "false"})
+
+	sessions, err := store.FetchByMeta(context.Background(), "mfa_verified", "true")
+	if err != nil {
+		t.Fatalf("unexpected error while fetching sessions by metadata: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != tagged.ID {
+		t.Errorf("want only the tagged session, got %v", sessions)
+	}
+
+	_, err = store.UpdateMeta(context.Background(), untagged.ID, nil, []string{"mfa_verified"})
+	if err != nil {
+		t.Fatalf("unexpected error while updating the metadata: %v", err)
+	}
+	assertMeta(untagged.ID, nil)
+
+	updated, err = store.UpdateMeta(context.Background(), "unknown", map[string]string{"mfa_verified": "true"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error while updating the metadata of an unknown session: %v", err)
+	}
+	if updated {
+		t.Error("expected the metadata of an unknown session not to be updated, but it was")
+	}
+}
+
+func TestSessionExpiryAcrossTimeZonesIntegration(t *testing.T) {
+	zones := []*time.Location{
+		time.UTC,
+		time.FixedZone("UTC+14", 14*60*60),
+		time.FixedZone("UTC-12", -12*60*60),
+		time.FixedZone("UTC+05:30", 5*60*60+30*60),
+	}
+	if paris, err := time.LoadLocation("Europe/Paris"); err == nil {
+		zones = append(zones, paris)
+	}
+	defaultLocal := time.Local
+	defer func() { time.Local = defaultLocal }()
+
+	for _, zone := range zones {
+		t.Run(zone.String(), func(t *testing.T) {
+			time.Local = zone
+
+			db, err := sql.Open(driverName, withDriverParams("file:database.db?mode=memory"))
+			if err != nil {
+				db.Close()
+				t.Fatalf("could not open in-memory database: %v", err)
+			}
+			defer db.Close()
+
+			store, err := sqlitestore.New(db, "sessions", 0)
+			if err != nil {
+				t.Fatalf("could not create a new sessions table: %v", err)
+			}
+
+			now := time.Now().In(zone)
+			validSession := sessionup.Session{
+				CreatedAt: now.Add(time.Minute * -30),
+				ExpiresAt: now.Add(time.Minute * 30),
+				ID:        "valid",
+				UserKey:   "key",
+			}
+			expiredSession := sessionup.Session{
+				CreatedAt: now.Add(time.Hour * -1),
+				ExpiresAt: now.Add(time.Minute * -30),
+				ID:        "expired",
+				UserKey:   "key",
+			}
+			for _, s := range []sessionup.Session{validSession, expiredSession} {
+				err = store.Create(context.Background(), s)
+				if err != nil {
+					t.Fatalf("could not create a session: %v", err)
+				}
+			}
+
+			retrievedSession, ok, err := store.FetchByID(context.Background(), "valid")
+			if err != nil {
+				t.Fatalf("unexpected error while fetching the session by its ID: %v", err)
+			}
+			if !ok {
+				t.Fatalf("expected to find session by its ID, but it was not found")
+			}
+			assertSessionEquals(t, retrievedSession, validSession)
+
+			_, ok, err = store.FetchByID(context.Background(), "expired")
+			if err != nil {
+				t.Fatalf("unexpected error while fetching the expired session by its ID: %v", err)
+			}
+			if ok {
+				t.Fatalf("expected not to find an expired session by its ID, but it was found")
+			}
+		})
 	}
 }
 
@@ -8,23 +8,22 @@ import (
 	"fmt"
 	"net"
 	"reflect"
-	"strings"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	sqlite3 "github.com/mattn/go-sqlite3"
 	"github.com/swithek/sessionup"
 )
 
 var errDiskError = errors.New("Disk error")
 
+// now is a point in time expressed in a time zone other than UTC.
+var now = time.Date(2021, time.November, 8, 10, 0, 0, 0, time.FixedZone("UTC+01:00", 60*60))
+
 func TestCreate(t *testing.T) {
-	db, mock := mockDB(t)
-	defer db.Close()
-	store := SqliteStore{db: db, tableName: "sessions"}
+	store, mock := newMockStore(t)
 
-	query := "INSERT INTO sessions VALUES ($1, $2, $3, $4, $5, $6, $7, $8);"
+	query := `INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
 	session := sessionup.Session{
 		CreatedAt: time.Now(),
 		ExpiresAt: time.Now(),
@@ -43,31 +42,29 @@ func TestCreate(t *testing.T) {
 		"should return Duplicate ID error": {
 			Expect: func() {
 				mock.ExpectExec(query).WithArgs(
-					session.CreatedAt,
-					session.ExpiresAt,
+					session.CreatedAt.UTC(),
+					session.ExpiresAt.UTC(),
 					session.ID,
 					session.UserKey,
 					session.IP.String(),
 					session.Agent.OS,
 					session.Agent.Browser,
-					"test:1;",
-				).WillReturnError(sqlite3.Error{
-					Code: sqlite3.ErrConstraint,
-				})
+					`{"test":"1"}`,
+				).WillReturnError(codeError(sqliteConstraint))
 			},
 			ExpectedError: sessionup.ErrDuplicateID,
 		},
 		"should return other kinds of error": {
 			Expect: func() {
 				mock.ExpectExec(query).WithArgs(
-					session.CreatedAt,
-					session.ExpiresAt,
+					session.CreatedAt.UTC(),
+					session.ExpiresAt.UTC(),
 					session.ID,
 					session.UserKey,
 					session.IP.String(),
 					session.Agent.OS,
 					session.Agent.Browser,
-					"test:1;",
+					`{"test":"1"}`,
 				).WillReturnError(errDiskError)
 			},
 			ExpectedError: errDiskError,
@@ -75,14 +72,14 @@ func TestCreate(t *testing.T) {
 		"successful create": {
 			Expect: func() {
 				mock.ExpectExec(query).WithArgs(
-					session.CreatedAt,
-					session.ExpiresAt,
+					session.CreatedAt.UTC(),
+					session.ExpiresAt.UTC(),
 					session.ID,
 					session.UserKey,
 					session.IP.String(),
 					session.Agent.OS,
 					session.Agent.Browser,
-					"test:1;",
+					`{"test":"1"}`,
 				).WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 		},
@@ -156,14 +153,12 @@ func TestFetchByID(t *testing.T) {
 		}
 	}
 
-	db, mock := mockDB(t)
-	defer db.Close()
-	store := SqliteStore{db: db, tableName: "sessions"}
+	store, mock := newMockStore(t)
 
-	query := "SELECT * FROM sessions WHERE id = $1 AND expires_at > datetime('now', 'localtime');"
+	query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
 	session := sessionup.Session{
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(time.Hour * 1),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: time.Now().UTC().Add(time.Hour * 1),
 		ID:        "id",
 		UserKey:   "key",
 		IP:        net.ParseIP("127.0.0.1"),
@@ -178,7 +173,7 @@ func TestFetchByID(t *testing.T) {
 	}{
 		"should return found = false when it gets sql.ErrNoRows": {
 			Expect: func() {
-				mock.ExpectQuery(query).WithArgs(session.ID).WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(query).WithArgs(session.ID, now.UTC()).WillReturnError(sql.ErrNoRows)
 			},
 			Checks: checks(
 				expectNoError(),
@@ -187,7 +182,7 @@ func TestFetchByID(t *testing.T) {
 		},
 		"should return other kinds of error": {
 			Expect: func() {
-				mock.ExpectQuery(query).WithArgs(session.ID).WillReturnError(errDiskError)
+				mock.ExpectQuery(query).WithArgs(session.ID, now.UTC()).WillReturnError(errDiskError)
 			},
 			Checks: checks(
 				expectAnError(errDiskError),
@@ -197,8 +192,8 @@ func TestFetchByID(t *testing.T) {
 		"should return a Session and found = true": {
 			Expect: func() {
 				rows := sqlmock.NewRows([]string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}).
-					AddRow(session.CreatedAt, session.ExpiresAt, session.ID, session.UserKey, session.IP.String(), session.Agent.OS, session.Agent.Browser, "test:1;:val;")
-				mock.ExpectQuery(query).WithArgs(session.ID).WillReturnRows(rows)
+					AddRow(session.CreatedAt, session.ExpiresAt, session.ID, session.UserKey, session.IP.String(), session.Agent.OS, session.Agent.Browser, `{"test":"1","":"val"}`)
+				mock.ExpectQuery(query).WithArgs(session.ID, now.UTC()).WillReturnRows(rows)
 			},
 			Checks: checks(
 				expectNoError(),
@@ -219,6 +214,116 @@ func TestFetchByID(t *testing.T) {
 	}
 }
 
+func TestFetchByIDWithSlidingExpiration(t *testing.T) {
+	store, mock := newMockStore(t, WithSlidingExpiration(time.Hour, time.Minute*30))
+	fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
+	extendQuery := `UPDATE "sessions" SET expires_at = $1 WHERE id = $2 AND expires_at > $3 AND expires_at < $1;`
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}
+	extendedExpiresAt := now.UTC().Add(time.Hour)
+
+	t.Run("does not extend a session far from expiring", func(t *testing.T) {
+		rows := sqlmock.NewRows(columns).AddRow(now, now.Add(time.Minute*45), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(rows)
+		session, ok, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !ok || !session.ExpiresAt.Equal(now.Add(time.Minute*45)) {
+			t.Errorf("want the session to expire at %s, got %s", now.Add(time.Minute*45), session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("extends a session about to expire", func(t *testing.T) {
+		rows := sqlmock.NewRows(columns).AddRow(now, now.Add(time.Minute*10), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(rows)
+		mock.ExpectExec(extendQuery).WithArgs(extendedExpiresAt, "id", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		session, ok, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !ok || !session.ExpiresAt.Equal(extendedExpiresAt) {
+			t.Errorf("want the session to expire at %s, got %s", extendedExpiresAt, session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("keeps the expiration time when the session was extended concurrently", func(t *testing.T) {
+		rows := sqlmock.NewRows(columns).AddRow(now, now.Add(time.Minute*10), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(rows)
+		mock.ExpectExec(extendQuery).WithArgs(extendedExpiresAt, "id", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+		session, _, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !session.ExpiresAt.Equal(now.Add(time.Minute * 10)) {
+			t.Errorf("want the session to expire at %s, got %s", now.Add(time.Minute*10), session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("when extending fails, it should return the error", func(t *testing.T) {
+		rows := sqlmock.NewRows(columns).AddRow(now, now.Add(time.Minute*10), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(rows)
+		mock.ExpectExec(extendQuery).WithArgs(extendedExpiresAt, "id", now.UTC()).WillReturnError(errDiskError)
+		_, ok, err := store.FetchByID(context.Background(), "id")
+		assertError(t, errDiskError, err)
+		if ok {
+			t.Error("expected found = false when extending fails, but got true")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestFetchWithMaxLifetime(t *testing.T) {
+	store, mock := newMockStore(t, WithMaxLifetime(time.Hour*24))
+	cutoff := now.UTC().Add(time.Hour * -24)
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}
+
+	t.Run("FetchByID ignores sessions older than the maximum lifetime", func(t *testing.T) {
+		query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2 AND created_at > $3;`
+		mock.ExpectQuery(query).WithArgs("id", now.UTC(), cutoff).WillReturnError(sql.ErrNoRows)
+		_, ok, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if ok {
+			t.Error("want found = false, got true")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("FetchByID caps the expiration time to the end of the lifetime", func(t *testing.T) {
+		query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2 AND created_at > $3;`
+		createdAt := now.Add(time.Hour * -23)
+		rows := sqlmock.NewRows(columns).AddRow(createdAt, now.Add(time.Hour*2), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(query).WithArgs("id", now.UTC(), cutoff).WillReturnRows(rows)
+		session, _, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if expected := createdAt.Add(time.Hour * 24); !session.ExpiresAt.Equal(expected) {
+			t.Errorf("want the session to expire at %s, got %s", expected, session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("FetchByUserKey ignores sessions older than the maximum lifetime", func(t *testing.T) {
+		query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE user_key = $1 AND expires_at > $2 AND created_at > $3;`
+		mock.ExpectQuery(query).WithArgs("key", now.UTC(), cutoff).WillReturnRows(sqlmock.NewRows(columns))
+		_, err := store.FetchByUserKey(context.Background(), "key")
+		assertNoError(t, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("sliding expiration does not extend sessions beyond the maximum lifetime", func(t *testing.T) {
+		store, mock := newMockStore(t, WithMaxLifetime(time.Hour*24), WithSlidingExpiration(time.Hour, time.Minute*30))
+		fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2 AND created_at > $3;`
+		extendQuery := `UPDATE "sessions" SET expires_at = $1 WHERE id = $2 AND expires_at > $3 AND created_at > $4 AND expires_at < $1;`
+		createdAt := now.UTC().Add(time.Hour*-23 - time.Minute*30)
+		lifetimeEnd := createdAt.Add(time.Hour * 24)
+		rows := sqlmock.NewRows(columns).AddRow(createdAt, now.Add(time.Minute*10), "id", "key", nil, nil, nil, nil)
+		mock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC(), cutoff).WillReturnRows(rows)
+		mock.ExpectExec(extendQuery).WithArgs(lifetimeEnd, "id", now.UTC(), cutoff).WillReturnResult(sqlmock.NewResult(0, 1))
+		session, _, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !session.ExpiresAt.Equal(lifetimeEnd) {
+			t.Errorf("want the session to expire at %s, got %s", lifetimeEnd, session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
 func TestFetchByUserKey(t *testing.T) {
 	type check func(*testing.T, []sessionup.Session, error)
 
@@ -245,12 +350,10 @@ func TestFetchByUserKey(t *testing.T) {
 		}
 	}
 
-	db, mock := mockDB(t)
-	defer db.Close()
+	store, mock := newMockStore(t)
 	key := "key"
-	store := SqliteStore{db: db, tableName: "sessions"}
 
-	query := "SELECT * FROM sessions WHERE user_key = $1;"
+	query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE user_key = $1 AND expires_at > $2;`
 
 	generateSessions := func() []sessionup.Session {
 		var res []sessionup.Session
@@ -270,7 +373,7 @@ func TestFetchByUserKey(t *testing.T) {
 	}{
 		"should return nil when it gets sql.ErrNoRows": {
 			Expect: func() {
-				mock.ExpectQuery(query).WithArgs(key).WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(query).WithArgs(key, now.UTC()).WillReturnError(sql.ErrNoRows)
 			},
 			Checks: checks(
 				expectNoError(),
@@ -279,7 +382,7 @@ func TestFetchByUserKey(t *testing.T) {
 		},
 		"should return other kinds of error": {
 			Expect: func() {
-				mock.ExpectQuery(query).WithArgs(key).WillReturnError(errDiskError)
+				mock.ExpectQuery(query).WithArgs(key, now.UTC()).WillReturnError(errDiskError)
 			},
 			Checks: checks(
 				expectAnError(errDiskError),
@@ -290,9 +393,9 @@ func TestFetchByUserKey(t *testing.T) {
 			Expect: func() {
 				rows := sqlmock.NewRows([]string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"})
 				for _, session := range generateSessions() {
-					rows.AddRow(session.CreatedAt, session.ExpiresAt, session.ID, session.UserKey, session.IP, session.Agent.OS, session.Agent.Browser, "test:1;:val;")
+					rows.AddRow(session.CreatedAt, session.ExpiresAt, session.ID, session.UserKey, session.IP, session.Agent.OS, session.Agent.Browser, `{"test":"1","":"val"}`)
 				}
-				mock.ExpectQuery(query).WithArgs(key).WillReturnRows(rows)
+				mock.ExpectQuery(query).WithArgs(key, now.UTC()).WillReturnRows(rows)
 			},
 			Checks: checks(
 				expectNoError(),
@@ -313,6 +416,127 @@ func TestFetchByUserKey(t *testing.T) {
 	}
 }
 
+func TestFetchAllByUserKey(t *testing.T) {
+	store, mock := newMockStore(t)
+	key := "key"
+	query := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE user_key = $1;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectQuery(query).WithArgs(key).WillReturnError(errDiskError)
+		_, err := store.FetchAllByUserKey(context.Background(), key)
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns sessions whether they are expired or not", func(t *testing.T) {
+		expired := sessionup.Session{ExpiresAt: now.UTC().Add(-time.Hour), ID: "expired", UserKey: key}
+		rows := sqlmock.NewRows([]string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}).
+			AddRow(expired.CreatedAt, expired.ExpiresAt, expired.ID, expired.UserKey, nil, nil, nil, nil)
+		mock.ExpectQuery(query).WithArgs(key).WillReturnRows(rows)
+		sessions, err := store.FetchAllByUserKey(context.Background(), key)
+		assertNoError(t, err)
+		if expected := []sessionup.Session{expired}; !reflect.DeepEqual(expected, sessions) {
+			t.Errorf("want %v, got %v", expected, sessions)
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestTouch(t *testing.T) {
+	store, mock := newMockStore(t)
+	id := "id"
+	expiresAt := now.Add(time.Hour)
+	query := `UPDATE "sessions" SET expires_at = $1 WHERE id = $2 AND expires_at > $3;`
+
+	t.Run("when there is an error, it should return it", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(expiresAt.UTC(), id, now.UTC()).WillReturnError(errDiskError)
+		_, err := store.Touch(context.Background(), id, expiresAt)
+		assertError(t, errDiskError, err)
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("returns false when there is no unexpired session with the ID", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(expiresAt.UTC(), id, now.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+		touched, err := store.Touch(context.Background(), id, expiresAt)
+		assertNoError(t, err)
+		if touched {
+			t.Error("want touched = false, got true")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("updates the expiration time of the session in DB", func(t *testing.T) {
+		mock.ExpectExec(query).WithArgs(expiresAt.UTC(), id, now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+		touched, err := store.Touch(context.Background(), id, expiresAt)
+		assertNoError(t, err)
+		if !touched {
+			t.Error("want touched = true, got false")
+		}
+		assertExpectationsWereMet(t, mock)
+	})
+}
+
+func TestRotate(t *testing.T) {
+	store, mock := newMockStore(t)
+	expiresAt := now.Add(time.Hour)
+	rotateQuery := `INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip) SELECT created_at, $1, $2, user_key, ip, agent_os, agent_browser, metadata, last_seen_at, last_seen_ip FROM "sessions" WHERE id = $3 AND expires_at > $4;`
+	deleteQuery := `DELETE FROM "sessions" WHERE id = $1;`
+
+	tests := map[string]struct {
+		Expect          func()
+		ExpectedRotated bool
+		ExpectedError   error
+	}{
+		"should return sessionup.ErrDuplicateID when the new ID is already used": {
+			Expect: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnError(codeError(sqliteConstraint))
+				mock.ExpectRollback()
+			},
+			ExpectedError: sessionup.ErrDuplicateID,
+		},
+		"should return rotated = false when there is no unexpired session with the old ID": {
+			Expect: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+		},
+		"should roll back when deleting the old session fails": {
+			Expect: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(deleteQuery).WithArgs("old").WillReturnError(errDiskError)
+				mock.ExpectRollback()
+			},
+			ExpectedError: errDiskError,
+		},
+		"copies the session under the new ID and deletes the old one": {
+			Expect: func() {
+				mock.ExpectBegin()
+				mock.ExpectExec(rotateQuery).WithArgs(expiresAt.UTC(), "new", "old", now.UTC()).WillReturnResult(sqlmock.NewResult(2, 1))
+				mock.ExpectExec(deleteQuery).WithArgs("old").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			},
+			ExpectedRotated: true,
+		},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			testDefinition.Expect()
+			rotated, err := store.Rotate(context.Background(), "old", "new", expiresAt)
+			if !errors.Is(err, testDefinition.ExpectedError) {
+				t.Errorf("want %v, got %v", testDefinition.ExpectedError, err)
+			}
+			if rotated != testDefinition.ExpectedRotated {
+				t.Errorf("want rotated = %t, got %t", testDefinition.ExpectedRotated, rotated)
+			}
+			assertExpectationsWereMet(t, mock)
+		})
+	}
+}
+
 func TestSerializeMetadata(t *testing.T) {
 	t.Run("Given nil, it will return a NULL string", func(t *testing.T) {
 		actual := serializeMetadata(nil)
@@ -321,51 +545,72 @@ func TestSerializeMetadata(t *testing.T) {
 		}
 	})
 
-	t.Run("Given a map of key/values, it will serialize it to a colon-separated string of key:value", func(t *testing.T) {
-		source := map[string]string{"": "1", "key": "", "test1": "2", "3": "", "hello": "hello"}
+	t.Run("Given a map of key/values, it will serialize it to a JSON object", func(t *testing.T) {
+		source := map[string]string{"": "1", "key": "", "url": "https://example.com/?a=1;b=2"}
 		actual := serializeMetadata(source)
 		if !actual.Valid {
 			t.Fatalf("want a non-NULL string, got a NULL string")
 		}
-		serialized := actual.String
-		assertStringContains(t, serialized, ":1;")
-		assertStringContains(t, serialized, "key:;")
-		assertStringContains(t, serialized, "test1:2;")
-		assertStringContains(t, serialized, "3:;")
-		assertStringContains(t, serialized, "hello:hello;")
+		expected := `{"":"1","key":"","url":"https://example.com/?a=1;b=2"}`
+		if actual.String != expected {
+			t.Errorf("want %q, got %q", expected, actual.String)
+		}
 	})
 }
 
-func assertStringContains(t *testing.T, haystack, needle string) {
-	t.Helper()
-	if !strings.Contains(haystack, needle) {
-		t.Errorf("expected haystack %q to contain %q but it did not", haystack, needle)
-	}
-}
-
 func TestParseMetadata(t *testing.T) {
 	t.Run("Given NULL string, it will return nil", func(t *testing.T) {
-		actual := parseMetadata(wrapNullString(""))
+		actual, err := parseMetadata(wrapNullString(""))
+		assertNoError(t, err)
 		if actual != nil {
 			t.Errorf("want nil, got %v", actual)
 		}
 	})
 
-	t.Run("Given a colon-separated list of key:value, it will split it into a map", func(t *testing.T) {
-		actual := parseMetadata(wrapNullString("test:1;:;3:3"))
+	t.Run("Given a JSON object, it will convert it into a map", func(t *testing.T) {
+		actual, err := parseMetadata(wrapNullString(`{"test":"1","":"","3":"3"}`))
+		assertNoError(t, err)
 		expected := map[string]string{"test": "1", "": "", "3": "3"}
 		if !reflect.DeepEqual(expected, actual) {
 			t.Errorf("want %v, got %v", expected, actual)
 		}
 	})
+
+	t.Run("Given an invalid JSON object, it will return an error", func(t *testing.T) {
+		_, err := parseMetadata(wrapNullString("test:1;"))
+		if err == nil {
+			t.Errorf("expected an error but did not get one")
+		}
+	})
+
+	t.Run("Given a serialized map, it will return the same map", func(t *testing.T) {
+		source := map[string]string{
+			"url":              "https://example.com:8080/path?a=1;b=2",
+			"key:with;symbols": `{"nested": "json"}`,
+			"time":             "2021-11-08T10:00:00+01:00",
+			"":                 "",
+			"unicode":          "héhé \u2028 \"quoted\"",
+		}
+		actual, err := parseMetadata(serializeMetadata(source))
+		assertNoError(t, err)
+		if !reflect.DeepEqual(source, actual) {
+			t.Errorf("want %v, got %v", source, actual)
+		}
+	})
+}
+
+func TestParseLegacyMetadata(t *testing.T) {
+	actual := parseLegacyMetadata("test:1;:;3:3")
+	expected := map[string]string{"test": "1", "": "", "3": "3"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("want %v, got %v", expected, actual)
+	}
 }
 
 func TestDeleteByID(t *testing.T) {
-	db, mock := mockDB(t)
-	defer db.Close()
+	store, mock := newMockStore(t)
 	id := "id"
-	store := SqliteStore{db: db, tableName: "sessions"}
-	query := "DELETE FROM sessions WHERE id = $1;"
+	query := `DELETE FROM "sessions" WHERE id = $1;`
 
 	t.Run("when there is an error, it should return it", func(t *testing.T) {
 		mock.ExpectExec(query).WithArgs(id).WillReturnError(errDiskError)
@@ -386,12 +631,70 @@ func TestDeleteByID(t *testing.T) {
 	})
 }
 
+func TestReadAndWritePools(t *testing.T) {
+	fetchQuery := `SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE id = $1 AND expires_at > $2;`
+	columns := []string{"created_at", "expires_at", "id", "user_key", "ip", "agent_os", "agent_browser", "metadata"}
+
+	t.Run("fetches sessions with the read pool", func(t *testing.T) {
+		store, readMock, writeMock := newMockPoolsStore(t)
+		readMock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(now.UTC(), now.UTC().Add(time.Hour), "id", "key", nil, nil, nil, nil),
+		)
+		readMock.ExpectQuery(`SELECT created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata FROM "sessions" WHERE user_key = $1 AND expires_at > $2;`).
+			WithArgs("key", now.UTC()).WillReturnRows(sqlmock.NewRows(columns))
+
+		_, found, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !found {
+			t.Error("want the session to be found")
+		}
+		_, err = store.FetchByUserKey(context.Background(), "key")
+		assertNoError(t, err)
+		assertExpectationsWereMet(t, readMock)
+		assertExpectationsWereMet(t, writeMock)
+	})
+
+	t.Run("writes sessions with the write pool", func(t *testing.T) {
+		store, readMock, writeMock := newMockPoolsStore(t)
+		writeMock.ExpectExec(`DELETE FROM "sessions" WHERE id = $1;`).WithArgs("id").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		assertNoError(t, store.DeleteByID(context.Background(), "id"))
+		assertExpectationsWereMet(t, readMock)
+		assertExpectationsWereMet(t, writeMock)
+	})
+
+	t.Run("extends fetched sessions with the write pool", func(t *testing.T) {
+		store, readMock, writeMock := newMockPoolsStore(t, WithSlidingExpiration(time.Hour, time.Minute*30))
+		readMock.ExpectQuery(fetchQuery).WithArgs("id", now.UTC()).WillReturnRows(
+			sqlmock.NewRows(columns).AddRow(now.UTC(), now.UTC().Add(time.Minute), "id", "key", nil, nil, nil, nil),
+		)
+		writeMock.ExpectExec(`UPDATE "sessions" SET expires_at = $1 WHERE id = $2 AND expires_at > $3 AND expires_at < $1;`).
+			WithArgs(now.UTC().Add(time.Hour), "id", now.UTC()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		session, _, err := store.FetchByID(context.Background(), "id")
+		assertNoError(t, err)
+		if !session.ExpiresAt.Equal(now.Add(time.Hour)) {
+			t.Errorf("want the session to expire at %s, got %s", now.Add(time.Hour), session.ExpiresAt)
+		}
+		assertExpectationsWereMet(t, readMock)
+		assertExpectationsWereMet(t, writeMock)
+	})
+
+	t.Run("releases the statements of both pools", func(t *testing.T) {
+		store, _, _ := newMockPoolsStore(t)
+		assertNoError(t, store.Close(context.Background()))
+
+		_, err := store.FetchByUserKey(context.Background(), "key")
+		if err == nil {
+			t.Error("expected an error when using a closed store, but did not get one")
+		}
+	})
+}
+
 func TestDeleteByUserKey(t *testing.T) {
-	db, mock := mockDB(t)
-	defer db.Close()
+	store, mock := newMockStore(t)
 	key := "key"
 	ids := []string{"id1", "id2", "id3"}
-	store := SqliteStore{db: db, tableName: "sessions"}
 
 	tests := map[string]struct {
 		Expect           func()
@@ -400,20 +703,20 @@ func TestDeleteByUserKey(t *testing.T) {
 	}{
 		"should return errors when deleting": {
 			Expect: func() {
-				query := "DELETE FROM sessions WHERE user_key = $1;"
+				query := `DELETE FROM "sessions" WHERE user_key = $1;`
 				mock.ExpectExec(query).WithArgs(key).WillReturnError(errDiskError)
 			},
 			ExpectedError: errDiskError,
 		},
 		"deletes all sessions by user key": {
 			Expect: func() {
-				query := "DELETE FROM sessions WHERE user_key = $1;"
+				query := `DELETE FROM "sessions" WHERE user_key = $1;`
 				mock.ExpectExec(query).WithArgs(key).WillReturnResult(sqlmock.NewResult(0, 1))
 			},
 		},
 		"should return errors when deleting with exceptions": {
 			Expect: func() {
-				query := "DELETE FROM sessions WHERE user_key = $1 AND id NOT IN (?,?,?);"
+				query := `DELETE FROM "sessions" WHERE user_key = $1 AND id NOT IN (?,?,?);`
 				expectedParams := append([]driver.Value{key}, "id1", "id2", "id3")
 				mock.ExpectExec(query).WithArgs(expectedParams...).WillReturnError(errDiskError)
 			},
@@ -422,7 +725,7 @@ func TestDeleteByUserKey(t *testing.T) {
 		},
 		"deletes all sessions except the IDs given in parameter": {
 			Expect: func() {
-				query := "DELETE FROM sessions WHERE user_key = $1 AND id NOT IN (?,?,?);"
+				query := `DELETE FROM "sessions" WHERE user_key = $1 AND id NOT IN (?,?,?);`
 				expectedParams := append([]driver.Value{key}, "id1", "id2", "id3")
 				mock.ExpectExec(query).WithArgs(expectedParams...).WillReturnResult(sqlmock.NewResult(0, 1))
 			},
@@ -442,26 +745,74 @@ func TestDeleteByUserKey(t *testing.T) {
 	}
 }
 
-func TestDeleteExpired(t *testing.T) {
+// stoppedClock is a Clock frozen at the given time.
+type stoppedClock struct {
+	now time.Time
+}
+
+func (clock stoppedClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock stoppedClock) NewTicker(d time.Duration) Ticker {
+	return realClock{}.NewTicker(d)
+}
+
+// manualTicker is a Ticker that ticks whenever a time is sent on it.
+type manualTicker chan time.Time
+
+func (ticker manualTicker) C() <-chan time.Time {
+	return ticker
+}
+
+func (ticker manualTicker) Stop() {}
+
+// newMockStore returns a store configured by the given options, with its
+// statements prepared on a mock database. Its clock is stopped at now.
+func newMockStore(t *testing.T, opts ...Option) (*SqliteStore, sqlmock.Sqlmock) {
+	t.Helper()
+
 	db, mock := mockDB(t)
-	defer db.Close()
+	t.Cleanup(func() { db.Close() })
+	store, err := newStore(db, newOptions(append([]Option{WithClock(stoppedClock{now})}, opts...)...))
+	if err != nil {
+		t.Fatalf("could not create the store: %v", err)
+	}
+	for _, query := range store.queries() {
+		mock.ExpectPrepare(query)
+	}
+	if err = store.prepareStatements(context.Background()); err != nil {
+		t.Fatalf("could not prepare the statements of the store: %v", err)
+	}
+	return store, mock
+}
 
-	store := SqliteStore{db: db, tableName: "sessions"}
-	query := "DELETE FROM sessions WHERE expires_at < datetime('now', 'localtime');"
+// newMockPoolsStore returns a store reading sessions with a read pool and
+// writing them with a write pool, along with the mocks of both pools.
+func newMockPoolsStore(t *testing.T, opts ...Option) (store *SqliteStore, readMock, writeMock sqlmock.Sqlmock) {
+	t.Helper()
 
-	t.Run("when there is an error, it should return it", func(t *testing.T) {
-		mock.ExpectExec(query).WillReturnError(errDiskError)
-		err := store.deleteExpired()
-		assertError(t, errDiskError, err)
-		assertExpectationsWereMet(t, mock)
-	})
+	readDB, readMock := mockDB(t)
+	t.Cleanup(func() { readDB.Close() })
+	writeDB, writeMock := mockDB(t)
+	t.Cleanup(func() { writeDB.Close() })
+	store, err := newStore(writeDB, newOptions(append([]Option{WithClock(stoppedClock{now})}, opts...)...))
+	if err != nil {
+		t.Fatalf("could not create the store: %v", err)
+	}
+	store.readDB = readDB
 
-	t.Run("deletes all the expired sessions in DB", func(t *testing.T) {
-		mock.ExpectExec(query).WillReturnResult(sqlmock.NewResult(0, 1))
-		err := store.deleteExpired()
-		assertNoError(t, err)
-		assertExpectationsWereMet(t, mock)
-	})
+	queries := store.queries()
+	for _, query := range queries {
+		writeMock.ExpectPrepare(query)
+	}
+	for _, s := range readOnlyStatements {
+		readMock.ExpectPrepare(queries[s])
+	}
+	if err = store.prepareStatements(context.Background()); err != nil {
+		t.Fatalf("could not prepare the statements of the store: %v", err)
+	}
+	return store, readMock, writeMock
 }
 
 func mockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
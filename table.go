@@ -0,0 +1,88 @@
+package sqlitestore
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// InvalidTableNameError is returned by New and NewWithOptions when the name
+// of the sessions table is not a valid identifier.
+type InvalidTableNameError struct {
+	// Name is the invalid table name.
+	Name string
+
+	// Reason explains why the name is invalid.
+	Reason string
+}
+
+func (e *InvalidTableNameError) Error() string {
+	return fmt.Sprintf("sqlitestore: invalid table name %q: %s", e.Name, e.Reason)
+}
+
+// tableName is the validated name of a table, optionally qualified by the
+// name of the attached database it belongs to.
+type tableName struct {
+	schema string
+	name   string
+}
+
+// parseTableName validates s and splits it into its schema and table names.
+// s is either a table name, like "sessions", or a schema-qualified one, like
+// "aux.sessions". Names are always quoted in queries, so reserved words and
+// special characters are allowed.
+func parseTableName(s string) (tableName, error) {
+	invalid := func(reason string) (tableName, error) {
+		return tableName{}, &InvalidTableNameError{Name: s, Reason: reason}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 {
+		return invalid("it must be a table name optionally qualified by a schema name")
+	}
+	for _, part := range parts {
+		if part == "" {
+			return invalid("it must not be empty")
+		}
+		if strings.IndexFunc(part, unicode.IsControl) >= 0 {
+			return invalid("it must not contain control characters")
+		}
+	}
+
+	table := tableName{name: parts[len(parts)-1]}
+	if len(parts) == 2 {
+		table.schema = parts[0]
+	}
+	if strings.HasPrefix(strings.ToLower(table.name), "sqlite_") {
+		return invalid("names beginning with \"sqlite_\" are reserved by SQLite")
+	}
+	return table, nil
+}
+
+// String returns the quoted, schema-qualified name of the table, ready to be
+// used in a query.
+func (table tableName) String() string {
+	if table.schema == "" {
+		return quoteIdentifier(table.name)
+	}
+	return quoteIdentifier(table.schema) + "." + quoteIdentifier(table.name)
+}
+
+// unqualified returns the quoted name of the table without its schema.
+// CREATE INDEX requires the indexed table to be named this way, the index
+// being created in the schema of the table.
+func (table tableName) unqualified() string {
+	return quoteIdentifier(table.name)
+}
+
+// withSuffix returns the name of a companion object of the table, like its
+// migrations table or its indexes, in the same schema.
+func (table tableName) withSuffix(suffix string) tableName {
+	return tableName{schema: table.schema, name: table.name + suffix}
+}
+
+// quoteIdentifier quotes an SQL identifier so that it is never interpreted
+// as a keyword or as anything but an identifier.
+func quoteIdentifier(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
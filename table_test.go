@@ -0,0 +1,61 @@
+package sqlitestore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTableName(t *testing.T) {
+	tests := map[string]struct {
+		Name     string
+		Expected string
+	}{
+		"simple name":                  {Name: "sessions", Expected: `"sessions"`},
+		"reserved word":                {Name: "order", Expected: `"order"`},
+		"name with special characters": {Name: "my-sessions", Expected: `"my-sessions"`},
+		"name with quotes":             {Name: `x"; DROP TABLE users; --`, Expected: `"x""; DROP TABLE users; --"`},
+		"schema-qualified name":        {Name: "aux.sessions", Expected: `"aux"."sessions"`},
+	}
+
+	for testName, testDefinition := range tests {
+		t.Run(testName, func(t *testing.T) {
+			table, err := parseTableName(testDefinition.Name)
+			assertNoError(t, err)
+			if actual := table.String(); actual != testDefinition.Expected {
+				t.Errorf("want %s, got %s", testDefinition.Expected, actual)
+			}
+		})
+	}
+
+	invalidNames := map[string]string{
+		"empty name":              "",
+		"empty schema name":       ".sessions",
+		"empty table name":        "aux.",
+		"too many parts":          "main.aux.sessions",
+		"control characters":      "sessions\x00",
+		"name reserved by SQLite": "SQLITE_sessions",
+	}
+
+	for testName, name := range invalidNames {
+		t.Run(testName, func(t *testing.T) {
+			_, err := parseTableName(name)
+			var invalidNameError *InvalidTableNameError
+			if !errors.As(err, &invalidNameError) {
+				t.Fatalf("want an *InvalidTableNameError, got %v", err)
+			}
+			if invalidNameError.Name != name {
+				t.Errorf("want invalid name %q, got %q", name, invalidNameError.Name)
+			}
+		})
+	}
+}
+
+func TestTableNameWithSuffix(t *testing.T) {
+	table := tableName{schema: "aux", name: "sessions"}
+	if actual := table.withSuffix("_migrations").String(); actual != `"aux"."sessions_migrations"` {
+		t.Errorf("want %s, got %s", `"aux"."sessions_migrations"`, actual)
+	}
+	if actual := table.unqualified(); actual != `"sessions"` {
+		t.Errorf("want %s, got %s", `"sessions"`, actual)
+	}
+}
@@ -0,0 +1,142 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+
+	"github.com/swithek/sessionup"
+)
+
+// TxStore is a sessionup.Store that runs every operation of a SqliteStore in
+// a transaction. It is returned by WithTx.
+type TxStore struct {
+	store *SqliteStore
+	tx    *sql.Tx
+
+	// The sessions changed in the transaction are kept out of the caches of
+	// the store until the transaction ends: the deleted IDs and user keys
+	// out of the cache, the created IDs out of the negative cache.
+	mu              sync.Mutex
+	deletedIDs      []string
+	deletedUserKeys []string
+	createdIDs      []string
+}
+
+// WithTx returns a sessionup.Store that creates, fetches and deletes
+// sessions in tx, so that they are committed or rolled back along with the
+// other writes of the transaction. tx must have been started on the database
+// of the store. The returned store must not be used once tx is committed or
+// rolled back.
+// Sessions are configured as in the store: when the session limit is reached
+// and new sessions are rejected, Create removes the rejected session from tx
+// before returning the *SessionLimitError, leaving the rest of tx as is.
+// FetchByID does not use the caches of the store, as tx may hold changes
+// that are not committed. The sessions created or deleted in tx are kept out
+// of the caches until tx ends, so that they cannot be cached in the state tx
+// changes. Ending tx with the Commit or Rollback method of the returned
+// TxStore lets the caches hold them right away; otherwise they are kept out
+// until the TTL of the caches ends.
+func (store *SqliteStore) WithTx(tx *sql.Tx) *TxStore {
+	return &TxStore{store: store, tx: tx}
+}
+
+// Commit commits the transaction, then lets the caches of the store hold the
+// sessions changed in it again.
+func (t *TxStore) Commit() error {
+	defer t.release()
+	return t.tx.Commit()
+}
+
+// Rollback rolls the transaction back, then lets the caches of the store
+// hold the sessions changed in it again.
+func (t *TxStore) Rollback() error {
+	defer t.release()
+	return t.tx.Rollback()
+}
+
+// release unpins the sessions changed in the transaction from the caches of
+// the store.
+func (t *TxStore) release() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.store.now()
+	t.store.cache.unpin(t.deletedIDs, t.deletedUserKeys, now)
+	t.store.unknownIDs.unpin(t.createdIDs, nil, now)
+	t.deletedIDs, t.deletedUserKeys, t.createdIDs = nil, nil, nil
+}
+
+// pinDeleted keeps the sessions with the given IDs or user keys out of the
+// cache until the transaction ends.
+func (t *TxStore) pinDeleted(ids, userKeys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.store.cache.pin(ids, userKeys, t.store.now())
+	t.deletedIDs = append(t.deletedIDs, ids...)
+	t.deletedUserKeys = append(t.deletedUserKeys, userKeys...)
+}
+
+// pinCreated keeps the given ID out of the negative cache until the
+// transaction ends.
+func (t *TxStore) pinCreated(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.store.unknownIDs.pin([]string{id}, nil, t.store.now())
+	t.createdIDs = append(t.createdIDs, id)
+}
+
+// stmts returns the prepared statements of the store, bound to the
+// transaction.
+func (t *TxStore) stmts(ctx context.Context) func(statement) *sql.Stmt {
+	return func(s statement) *sql.Stmt {
+		return t.tx.StmtContext(ctx, t.store.stmt(s))
+	}
+}
+
+// Create implements sessionup.Store interface's Create method.
+func (t *TxStore) Create(ctx context.Context, session sessionup.Session) error {
+	t.pinCreated(session.ID)
+	stmt := t.stmts(ctx)
+	if t.store.sessionLimit <= 0 {
+		return t.store.insertSession(ctx, stmt(createStatement), session)
+	}
+
+	if t.store.limitPolicy == EvictOldestSessions {
+		t.pinDeleted(nil, []string{session.UserKey})
+	}
+	err := t.store.insertWithinLimit(ctx, t.tx, session)
+	var limitError *SessionLimitError
+	if errors.As(err, &limitError) {
+		// The transaction is not ours to roll back.
+		if _, deleteErr := stmt(deleteByIDStatement).ExecContext(ctx, session.ID); deleteErr != nil {
+			return deleteErr
+		}
+	}
+	return err
+}
+
+// FetchByID implements sessionup.Store interface's FetchByID method.
+func (t *TxStore) FetchByID(ctx context.Context, id string) (sessionup.Session, bool, error) {
+	return t.store.fetchByID(ctx, t.stmts(ctx), id)
+}
+
+// FetchByUserKey implements sessionup.Store interface's FetchByUserKey method.
+func (t *TxStore) FetchByUserKey(ctx context.Context, key string) ([]sessionup.Session, error) {
+	stmt := t.stmts(ctx)
+	return t.store.fetchSessions(ctx, stmt(fetchByUserKeyStatement), t.store.expiryArgs(t.store.now(), key)...)
+}
+
+// DeleteByID implements sessionup.Store interface's DeleteByID method.
+func (t *TxStore) DeleteByID(ctx context.Context, id string) error {
+	t.pinDeleted([]string{id}, nil)
+	stmt := t.stmts(ctx)
+	_, err := stmt(deleteByIDStatement).ExecContext(ctx, id)
+	return err
+}
+
+// DeleteByUserKey implements sessionup.Store interface's DeleteByUserKey method.
+func (t *TxStore) DeleteByUserKey(ctx context.Context, key string, sessionIDsToKeep ...string) error {
+	t.pinDeleted(nil, []string{key})
+	return t.store.deleteByUserKey(ctx, t.stmts(ctx), t.tx, key, sessionIDsToKeep)
+}
@@ -0,0 +1,67 @@
+package sqlitestore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/swithek/sessionup"
+)
+
+func TestWithTx(t *testing.T) {
+	insertQuery := `INSERT INTO "sessions" (created_at, expires_at, id, user_key, ip, agent_os, agent_browser, metadata) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`
+	countQuery := `SELECT COUNT(*) FROM "sessions" WHERE user_key = $1 AND expires_at > $2;`
+	deleteQuery := `DELETE FROM "sessions" WHERE id = $1;`
+	session := sessionup.Session{
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		ID:        "id",
+		UserKey:   "key",
+	}
+	beginTx := func(t *testing.T, store *SqliteStore, mock sqlmock.Sqlmock) *sql.Tx {
+		t.Helper()
+		mock.ExpectBegin()
+		tx, err := store.db.Begin()
+		if err != nil {
+			t.Fatalf("could not begin a transaction: %v", err)
+		}
+		return tx
+	}
+
+	t.Run("runs the operations in the transaction", func(t *testing.T) {
+		store, mock := newMockStore(t)
+		tx := beginTx(t, store, mock)
+		mock.ExpectExec(insertQuery).WithArgs(session.CreatedAt.UTC(), session.ExpiresAt.UTC(), session.ID, session.UserKey, nil, nil, nil, nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(deleteQuery).WithArgs("other").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectRollback()
+
+		txStore := store.WithTx(tx)
+		assertNoError(t, txStore.Create(context.Background(), session))
+		assertNoError(t, txStore.DeleteByID(context.Background(), "other"))
+		assertNoError(t, txStore.Rollback())
+		assertExpectationsWereMet(t, mock)
+	})
+
+	t.Run("removes only the rejected session from the transaction", func(t *testing.T) {
+		store, mock := newMockStore(t, WithSessionLimit(1, RejectNewSessions))
+		tx := beginTx(t, store, mock)
+		mock.ExpectExec(insertQuery).WithArgs(session.CreatedAt.UTC(), session.ExpiresAt.UTC(), session.ID, session.UserKey, nil, nil, nil, nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectQuery(countQuery).WithArgs(session.UserKey, now.UTC()).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectExec(deleteQuery).WithArgs(session.ID).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		txStore := store.WithTx(tx)
+		err := txStore.Create(context.Background(), session)
+		var limitError *SessionLimitError
+		if !errors.As(err, &limitError) {
+			t.Errorf("want a *SessionLimitError, got %v", err)
+		}
+		assertNoError(t, txStore.Commit())
+		assertExpectationsWereMet(t, mock)
+	})
+}